@@ -2,27 +2,49 @@ package main
 
 import (
 	"bufio"
-	"debug/buildinfo"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"slices"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/philz/git-stitch/internal/version"
 )
 
 type CommitInfo struct {
 	Hash               string
-	Message            string
+	Message            string // raw message bytes, passed to commit-tree verbatim
 	AuthorName         string
 	AuthorEmail        string
 	AuthorTimestamp    int64
+	AuthorTimezone     string // e.g. "-0800"
 	CommitterName      string
 	CommitterEmail     string
 	CommitterTimestamp int64
+	CommitterTimezone  string
+	MonorepoLocal      bool // has a "Monorepo-Local: true" trailer, so isn't ripped
+}
+
+// AuthorDate and CommitterDate format the commit's dates in git's raw
+// "<epoch> <offset>" form. Keeping the original offset, rather than letting
+// git fill in the local one, makes ripped commits independent of $TZ.
+func (c CommitInfo) AuthorDate() string {
+	return fmt.Sprintf("%d %s", c.AuthorTimestamp, c.AuthorTimezone)
+}
+
+func (c CommitInfo) CommitterDate() string {
+	return fmt.Sprintf("%d %s", c.CommitterTimestamp, c.CommitterTimezone)
 }
 
 type FileChange struct {
@@ -30,27 +52,226 @@ type FileChange struct {
 	Status string // "A" for added, "M" for modified, "D" for deleted
 }
 
-func getBuildInfo() string {
-	if info, err := buildinfo.ReadFile(os.Args[0]); err == nil {
-		if info.Main.Sum != "" {
-			return fmt.Sprintf("%s (%s)", info.Main.Version, info.Main.Sum)
+// revListOrderFlags maps the -order values to the git rev-list flag that
+// produces them. Every ordering still lists parents before their children.
+var revListOrderFlags = map[string]string{
+	"default":     "",
+	"author-date": "--author-date-order",
+	"date":        "--date-order",
+	"topo":        "--topo-order",
+}
+
+// defaultNotesRef is where -notes records ripped commits when no ref is given.
+const defaultNotesRef = "refs/notes/stitch"
+
+// notesFlag is the value of -notes: the notes ref to write to, or empty when
+// notes are off. Like a boolean flag, it can be given without a value.
+type notesFlag string
+
+func (n *notesFlag) String() string   { return string(*n) }
+func (n *notesFlag) IsBoolFlag() bool { return true }
+
+func (n *notesFlag) Set(value string) error {
+	switch value {
+	case "true":
+		*n = defaultNotesRef
+	case "false":
+		*n = ""
+	default:
+		*n = notesFlag(value)
+	}
+	return nil
+}
+
+// commitListFlag collects the values of a repeatable flag naming commits.
+type commitListFlag []string
+
+func (c *commitListFlag) String() string { return strings.Join(*c, ", ") }
+
+func (c *commitListFlag) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// Errors about the -exclude-commit values themselves, as opposed to git
+// failing, so that they can exit as usage errors.
+var (
+	errNoSuchCommit = errors.New("no such commit")
+	errNotRipped    = errors.New("not one of the commits being ripped")
+)
+
+// resolveExcludedCommits resolves the -exclude-commit values to full hashes,
+// checking that each is one of the commits about to be replayed.
+func resolveExcludedCommits(names []string, baseCommit string, firstParent bool) (map[string]bool, error) {
+	excluded := make(map[string]bool)
+	hashes := make([]string, len(names))
+	for i, name := range names {
+		output, err := gitCommand("rev-parse", "--verify", "--quiet", name+"^{commit}").Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			// --verify --quiet exits with 1 for an unknown revision
+			return nil, fmt.Errorf("-exclude-commit %s: %w", name, errNoSuchCommit)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to resolve -exclude-commit %s: %v", name, err)
+		}
+		hashes[i] = strings.TrimSpace(string(output))
+		excluded[hashes[i]] = true
+	}
+	if len(excluded) == 0 {
+		return excluded, nil
+	}
+
+	stream, err := streamCommitsSince(baseCommit, "default", firstParent)
+	if err != nil {
+		return nil, err
+	}
+	inRange := make(map[string]bool)
+	for hash, ok := stream.Next(); ok; hash, ok = stream.Next() {
+		if excluded[hash] {
+			inRange[hash] = true
 		}
-		return info.Main.Version
 	}
-	return "dev (unknown)"
+	if err := stream.Close(); err != nil {
+		return nil, fmt.Errorf("failed to list commits: %v", err)
+	}
+	for i, name := range names {
+		if !inRange[hashes[i]] {
+			return nil, fmt.Errorf("-exclude-commit %s: %w", name, errNotRipped)
+		}
+	}
+	return excluded, nil
+}
+
+// Exit codes, so that scripts can tell kinds of failure apart. Any other
+// failure exits with 1.
+const (
+	exitUsage       = 2 // bad command-line arguments
+	exitNotStitched = 3 // no git-stitch base commit in HEAD's history
+	exitGitFailure  = 4 // a git command failed
+)
+
+// stitchParentTrailer names the trailer git-stitch writes into the base
+// commit, mapping each directory to the parent commit it came from.
+const stitchParentTrailer = "Stitch-Parent"
+
+// stitchBaseTrailer names the trailer git-stitch writes into the base
+// commit to carry stitch.base-marker. It is how the base is found.
+const stitchBaseTrailer = "Stitch-Base"
+
+// stitchEmptyTrailer names the trailer git-stitch writes for each -empty
+// placeholder directory. Placeholders have no remote, so nothing is ripped
+// from them.
+const stitchEmptyTrailer = "Stitch-Empty"
+
+// monorepoLocalTrailer marks a monorepo commit that git-rip should skip, such
+// as a change to top-level CI that has no business in any remote.
+const monorepoLocalTrailer = "Monorepo-Local"
+
+// errNoBaseCommit is returned when HEAD's history has no base commit. The
+// base is searched for from HEAD, so it is always an ancestor when found.
+var errNoBaseCommit = errors.New("no git-stitch base commit in the history of HEAD; are you on the right branch?")
+
+// defaultBaseMarker is what identifies a base commit when stitch.base-marker
+// is unset. Base commits from before the marker existed have it as their
+// subject, so they are still found.
+const defaultBaseMarker = "git-stitch merge"
+
+// verbose enables diagnostic output. It defaults to on when
+// GIT_STITCH_VERBOSE is set, and the -v flag overrides that either way.
+var verbose = os.Getenv("GIT_STITCH_VERBOSE") != ""
+
+func verbosef(format string, args ...any) {
+	if verbose {
+		fmt.Printf(format, args...)
+	}
 }
 
 func main() {
-	if len(os.Args) > 1 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
-		fmt.Printf("git-rip %s\n", getBuildInfo())
+	flag.BoolVar(&verbose, "v", verbose, "print diagnostic output (also enabled by GIT_STITCH_VERBOSE)")
+	flag.BoolVar(&verbose, "verbose", verbose, "same as -v")
+	order := flag.String("order", "default", "replay order: default, author-date, date, or topo")
+	firstParent := flag.Bool("first-parent", false, "replay only mainline commits, folding merged branches into their merge commit")
+	var excludeCommits commitListFlag
+	flag.Var(&excludeCommits, "exclude-commit", "don't replay this `commit` (repeatable)")
+	timing := flag.Bool("timing", false, "print elapsed time and the number of git commands run")
+	committerDate := flag.String("committer-date", "original", "committer date for ripped commits: original, or now")
+	var notes notesFlag
+	flag.Var(&notes, "notes", "record the commits made for each monorepo commit as git notes, in -notes=<ref> if given (default "+defaultNotesRef+")")
+	fsck := flag.Bool("fsck", false, "instead of ripping, check that the branches of an earlier rip with this prefix match HEAD")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	prefixTimestampFormat := flag.String("prefix-timestamp-format", "", "Go time `layout` for the default prefix, like rip-2006-01-02-150405 (default rip-<unix time>)")
+	prefixFile := flag.String("prefix-file", "", "read the branch prefix from this file instead of the command line")
+	flag.CommandLine.SetOutput(os.Stdout)
+	flag.Usage = func() {
+		fmt.Printf("git-rip %s\n", version.String())
 		fmt.Printf("Splits monorepo commits back into separate repository branches.\n\n")
-		fmt.Printf("Usage: git-rip [prefix]\n")
-		fmt.Printf("\nIf no prefix is specified, 'rip-<timestamp>' is used.\n")
+		fmt.Printf("Usage: git-rip [-v] [-timing] [-order <order>] [-first-parent] [-exclude-commit <commit>]... [-committer-date <policy>] [-notes[=<ref>]] [-prefix-timestamp-format <layout>] [-prefix-file <path> | prefix]\n       git-rip -fsck [-prefix-file <path> | prefix]\n       git-rip -version\n")
+		fmt.Printf("\nIf no prefix is specified, 'rip-<timestamp>' is used, or the current time\nformatted with -prefix-timestamp-format.\n\n")
+		flag.PrintDefaults()
+		fmt.Printf("\nExit codes: %d usage error, %d not a stitched monorepo, %d git failure, 1 anything else\n",
+			exitUsage, exitNotStitched, exitGitFailure)
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("git-rip %s\n", version.String())
 		return
 	}
+
+	start := time.Now()
+	if *timing {
+		// Failures exit without running deferred calls, so this only
+		// reports runs that finish
+		defer func() {
+			// Sys only grows, so it's close to the peak, and unlike the
+			// process's resident size it leaves out the git commands
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			fmt.Printf("Finished in %s, running %d git commands, with %dMB of memory\n",
+				time.Since(start).Round(time.Millisecond), gitInvocations.Load(), mem.Sys/(1024*1024))
+		}()
+	}
+
+	removeTempIndexesOnSignal()
+
+	if _, ok := revListOrderFlags[*order]; !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown order %q\n", *order)
+		os.Exit(exitUsage)
+	}
+	if *committerDate != "original" && *committerDate != "now" {
+		fmt.Fprintf(os.Stderr, "Error: -committer-date must be original or now, not %q\n", *committerDate)
+		os.Exit(exitUsage)
+	}
+	if flag.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Error: expected at most one prefix, got %q\n", flag.Args())
+		os.Exit(exitUsage)
+	}
+	// Every ripped commit gets the same "now", like a single git rebase
+	now := time.Now()
+
 	prefix := ""
-	if len(os.Args) > 1 {
-		prefix = os.Args[1]
+	if *prefixFile != "" {
+		if flag.NArg() > 0 {
+			fmt.Fprintf(os.Stderr, "Error: give either a prefix or -prefix-file, not both\n")
+			os.Exit(exitUsage)
+		}
+		contents, err := os.ReadFile(*prefixFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading prefix file: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		prefix = strings.TrimSpace(string(contents))
+		if prefix == "" {
+			fmt.Fprintf(os.Stderr, "Error: prefix file %s is empty\n", *prefixFile)
+			os.Exit(exitUsage)
+		}
+	} else if flag.NArg() > 0 {
+		prefix = flag.Arg(0)
+	} else if *fsck {
+		fmt.Fprintf(os.Stderr, "Error: -fsck needs the prefix of the rip to check\n")
+		os.Exit(exitUsage)
+	} else if *prefixTimestampFormat != "" {
+		prefix = sanitizeRefName(time.Now().Format(*prefixTimestampFormat))
 	} else {
 		// Use timestamp-based prefix
 		prefix = fmt.Sprintf("rip-%d", time.Now().Unix())
@@ -60,20 +281,62 @@ func main() {
 	baseCommit, err := findBaseMergeCommit()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error finding base commit: %v\n", err)
-		os.Exit(1)
+		if errors.Is(err, errNoBaseCommit) {
+			os.Exit(exitNotStitched)
+		}
+		os.Exit(exitGitFailure)
+	}
+	verbosef("Found base commit: %s\n", baseCommit)
+
+	if *fsck {
+		remotes, err := getRemotesFromBaseCommit(baseCommit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting remotes from base commit: %v\n", err)
+			os.Exit(exitGitFailure)
+		}
+		problems, err := fsckBranches(prefix, remotes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitGitFailure)
+		}
+		for _, problem := range problems {
+			fmt.Printf("%s\n", problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("All %d branches with prefix %s match HEAD\n", len(remotes), prefix)
+		return
 	}
-	if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-		fmt.Printf("Found base commit: %s\n", baseCommit)
+
+	// git-stitch -no-parents makes a root commit, leaving nothing for the
+	// ripped branches to build on
+	if output, err := gitCommand("rev-parse", baseCommit+"^@").Output(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting parents of base commit: %v\n", err)
+		os.Exit(exitGitFailure)
+	} else if len(strings.TrimSpace(string(output))) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: base commit %s has no parents (was it stitched with -no-parents?), so there are no remote histories to rip onto\n", baseCommit)
+		os.Exit(exitNotStitched)
 	}
 
-	// Get list of commits since the base commit
-	commits, err := getCommitsSince(baseCommit)
+	// Count the commits since the base commit. They are only listed one
+	// by one as they are replayed, below.
+	commitCount, err := countCommitsSince(baseCommit, *firstParent)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error getting commits: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitGitFailure)
+	}
+
+	excluded, err := resolveExcludedCommits(excludeCommits, baseCommit, *firstParent)
+	if errors.Is(err, errNoSuchCommit) || errors.Is(err, errNotRipped) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitGitFailure)
 	}
 
-	if len(commits) == 0 {
+	if commitCount == 0 {
 		fmt.Println("No commits to rip since base commit")
 		return
 	}
@@ -82,7 +345,23 @@ func main() {
 	remotes, err := getRemotesFromBaseCommit(baseCommit)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error getting remotes from base commit: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitGitFailure)
+	}
+
+	placeholders, err := getStitchEmpty(baseCommit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitGitFailure)
+	}
+
+	// Check the branch names up front rather than failing after all the
+	// commits have been created
+	for _, remote := range remotes {
+		branchName := fmt.Sprintf("%s-%s", prefix, remote)
+		if err := gitCommand("check-ref-format", "--branch", branchName).Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %q is not a valid branch name\n", branchName)
+			os.Exit(exitUsage)
+		}
 	}
 
 	// Initialize branches for each remote at their original commit
@@ -92,130 +371,311 @@ func main() {
 		originalCommit, err := getOriginalCommitForRemote(baseCommit, remote)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error getting original commit for %s: %v\n", remote, err)
-			os.Exit(1)
+			os.Exit(exitGitFailure)
 		}
 		branchHeads[remote] = originalCommit
-		if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-			fmt.Printf("Remote %s starts from commit %s\n", remote, originalCommit)
-		}
+		verbosef("Remote %s starts from commit %s\n", remote, originalCommit)
 	}
 
 	// Process each commit
-	for _, commit := range commits {
-		if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-			fmt.Printf("Processing commit: %s\n", commit.Hash)
+	commits, err := streamCommitsSince(baseCommit, *order, *firstParent)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting commits: %v\n", err)
+		os.Exit(exitGitFailure)
+	}
+	for hash, ok := commits.Next(); ok; hash, ok = commits.Next() {
+		commit, err := getCommitInfo(hash)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to get info for commit %s: %v\n", hash, err)
+			continue
+		}
+		verbosef("Processing commit: %s\n", commit.Hash)
+
+		if commit.MonorepoLocal {
+			fmt.Printf("Skipping monorepo-local commit %s\n", commit.Hash)
+			continue
+		}
+		if excluded[commit.Hash] {
+			fmt.Printf("Skipping excluded commit %s\n", commit.Hash)
+			continue
+		}
+
+		if *committerDate == "now" {
+			commit.CommitterTimestamp = now.Unix()
+			commit.CommitterTimezone = now.Format("-0700")
 		}
 
 		// Get the files changed in this commit
-		changedFiles, err := getChangedFilesWithStatus(commit.Hash)
+		changedFiles, err := getChangedFilesWithStatus(commit.Hash, *firstParent)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error getting changed files for %s: %v\n", commit.Hash, err)
-			os.Exit(1)
+			os.Exit(exitGitFailure)
 		}
 
 		// Group files by remote (directory)
 		filesByRemote := make(map[string][]FileChange)
+		placeholderChanges := make(map[string]bool)
 		for _, fileChange := range changedFiles {
-			parts := strings.SplitN(fileChange.Path, "/", 2)
-			if len(parts) == 2 {
-				remote := parts[0]
-				filePath := parts[1]
-				if slices.Contains(remotes, remote) {
-					filesByRemote[remote] = append(filesByRemote[remote], FileChange{
-						Path:   filePath,
-						Status: fileChange.Status,
-					})
-				}
+			if remote, filePath, ok := remoteForPath(fileChange.Path, remotes); ok {
+				filesByRemote[remote] = append(filesByRemote[remote], FileChange{
+					Path:   filePath,
+					Status: fileChange.Status,
+				})
+			} else if placeholder, _, ok := remoteForPath(fileChange.Path, placeholders); ok {
+				placeholderChanges[placeholder] = true
+			}
+		}
+		for _, placeholder := range placeholders {
+			if placeholderChanges[placeholder] {
+				fmt.Fprintf(os.Stderr, "Warning: %s changes placeholder directory %s, which has no remote to rip to\n", commit.Hash, placeholder)
 			}
 		}
 
 		// Create a commit for each remote that has changed files
+		var created []string
 		for _, remote := range remotes {
 			fileChanges, hasChanges := filesByRemote[remote]
 			if !hasChanges {
 				continue
 			}
 
-			if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-				fmt.Printf("Creating commit for %s with file changes: %v\n", remote, fileChanges)
+			verbosef("Creating commit for %s with file changes: %v\n", remote, fileChanges)
+			// Each changed file becomes its own commit on the remote's
+			// branch. With -first-parent a merge stands in for its whole
+			// side branch, so its changes are squashed into one commit.
+			batches := [][]FileChange{fileChanges}
+			if !*firstParent {
+				batches = batches[:0]
+				for _, change := range fileChanges {
+					batches = append(batches, []FileChange{change})
+				}
 			}
-			// Create a tree with changes for this remote
-			newCommit, err := createCommitForRemoteWithChanges(commit, remote, fileChanges, branchHeads[remote])
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error creating commit for %s: %v\n", remote, err)
-				fmt.Fprintf(os.Stderr, "Commit details: %+v\n", commit)
-				fmt.Fprintf(os.Stderr, "Parent commit: %s\n", branchHeads[remote])
-				os.Exit(1)
+			for _, batch := range batches {
+				newCommit, err := createCommitForRemoteWithChanges(commit, remote, batch, branchHeads[remote])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error creating commit for %s: %v\n", remote, err)
+					fmt.Fprintf(os.Stderr, "Commit details: %+v\n", commit)
+					fmt.Fprintf(os.Stderr, "Parent commit: %s\n", branchHeads[remote])
+					os.Exit(exitGitFailure)
+				}
+
+				branchHeads[remote] = newCommit
+				verbosef("Created commit %s for %s\n", newCommit, remote)
 			}
+			created = append(created, fmt.Sprintf("%s: %s", remote, branchHeads[remote]))
+		}
 
-			branchHeads[remote] = newCommit
-			if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-				fmt.Printf("Created commit %s for %s\n", newCommit, remote)
+		if notes != "" && len(created) > 0 {
+			cmd := gitCommand("notes", "--ref="+string(notes), "add", "-f", "-m", strings.Join(created, "\n"), commit.Hash)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error adding note to %s: %v\n%s", commit.Hash, err, output)
+				os.Exit(exitGitFailure)
 			}
 		}
 	}
+	if err := commits.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting commits: %v\n", err)
+		os.Exit(exitGitFailure)
+	}
 
 	// Create branches
 	fmt.Println("Branches created:")
 	for _, remote := range remotes {
 		branchName := fmt.Sprintf("%s-%s", prefix, remote)
-		cmd := exec.Command("git", "branch", branchName, branchHeads[remote])
+		cmd := gitCommand("branch", branchName, branchHeads[remote])
 		if err := cmd.Run(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error creating branch %s: %v\n", branchName, err)
-			os.Exit(1)
+			os.Exit(exitGitFailure)
 		}
 		fmt.Printf("  %s\n", branchName)
 	}
 }
 
+// fsckBranches compares the tree of each remote's branch from an earlier
+// rip against that remote's directory in HEAD, which is what stitching the
+// branches again would reproduce. It returns a description of each
+// mismatch. Commits that rip skips, like monorepo-local ones, show up here
+// as differences.
+func fsckBranches(prefix string, remotes []string) ([]string, error) {
+	var problems []string
+	for _, remote := range remotes {
+		branchName := fmt.Sprintf("%s-%s", prefix, remote)
+		output, err := gitCommand("rev-parse", "--verify", "--quiet", "refs/heads/"+branchName+"^{tree}").Output()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: branch %s doesn't exist", remote, branchName))
+			continue
+		}
+		branchTree := strings.TrimSpace(string(output))
+
+		output, err = gitCommand("rev-parse", "--verify", "--quiet", "HEAD:"+remote).Output()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: HEAD has no directory %s", remote, remote))
+			continue
+		}
+		headTree := strings.TrimSpace(string(output))
+		if branchTree == headTree {
+			verbosef("Branch %s matches HEAD:%s (tree %s)\n", branchName, remote, headTree)
+			continue
+		}
+
+		output, err = gitCommand("diff-tree", "-r", "--no-renames", "--name-status", headTree, branchTree).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare %s with HEAD:%s: %v", branchName, remote, err)
+		}
+		problems = append(problems, fmt.Sprintf("%s: branch %s differs from HEAD:%s\n%s",
+			remote, branchName, remote, strings.TrimRight(string(output), "\n")))
+	}
+	return problems, nil
+}
+
+// sanitizeRefName replaces the characters git doesn't allow in ref names,
+// like the colons and spaces of a formatted time, with dashes.
+func sanitizeRefName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || strings.ContainsRune(" ~^:?*[\\", r) {
+			return '-'
+		}
+		return r
+	}, name)
+	for strings.Contains(name, "..") {
+		name = strings.ReplaceAll(name, "..", ".")
+	}
+	return strings.ReplaceAll(name, "@{", "@-")
+}
+
+// findBaseMergeCommit returns the most recent base commit in HEAD's
+// history: one whose Stitch-Base trailer is the marker, or, for bases from
+// before the trailer existed, one with no such trailer whose subject is the
+// marker. A commit that merely mentions the marker doesn't count.
 func findBaseMergeCommit() (string, error) {
-	cmd := exec.Command("git", "log", "--grep=git-stitch merge", "--format=%H", "-1")
+	marker := getConfig("stitch.base-marker", defaultBaseMarker)
+	// --grep narrows the search to likely candidates, which are then
+	// checked exactly, since it can't tell a trailer from a line that
+	// happens to look like one
+	quoted := regexp.QuoteMeta(marker)
+	format := fmt.Sprintf("--format=%%H%%x00%%s%%x00%%(trailers:key=%s,valueonly)%%x00", stitchBaseTrailer)
+	cmd := gitCommand("log", "-E", "--grep=^"+stitchBaseTrailer+": *"+quoted+" *$", "--grep=^"+quoted+"$", format)
 	output, err := cmd.Output()
 	if err != nil {
 		return "", err
 	}
-	commitHash := strings.TrimSpace(string(output))
-	if commitHash == "" {
-		return "", fmt.Errorf("no merge commit found with message 'git-stitch merge'")
+	fields := strings.Split(string(output), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		commitHash := strings.TrimSpace(fields[i])
+		subject := fields[i+1]
+		values := strings.TrimSpace(fields[i+2])
+		if values == "" {
+			if subject == marker {
+				return commitHash, nil
+			}
+			continue
+		}
+		for _, value := range strings.Split(values, "\n") {
+			if strings.TrimSpace(value) == marker {
+				return commitHash, nil
+			}
+		}
 	}
-	return commitHash, nil
+	if isShallowRepository() {
+		return "", fmt.Errorf("%w (this repository is shallow, so the base commit may be before the shallow boundary; try git fetch --unshallow)", errNoBaseCommit)
+	}
+	return "", fmt.Errorf("%w (looked for %q)", errNoBaseCommit, marker)
 }
 
-func getCommitsSince(baseCommit string) ([]CommitInfo, error) {
-	cmd := exec.Command("git", "rev-list", "--reverse", fmt.Sprintf("%s..HEAD", baseCommit))
-	output, err := cmd.Output()
+// gitInvocations counts the git commands run, for -timing.
+var gitInvocations atomic.Int64
+
+// gitCommand returns an exec.Cmd that runs git with args. Every git command
+// goes through here so that -timing can count them.
+func gitCommand(args ...string) *exec.Cmd {
+	gitInvocations.Add(1)
+	return exec.Command("git", args...)
+}
+
+// getConfig returns the value of a git config key, or defaultValue if unset.
+func getConfig(key, defaultValue string) string {
+	output, err := gitCommand("config", "--get", key).Output()
 	if err != nil {
-		return nil, err
+		return defaultValue
 	}
+	return strings.TrimSpace(string(output))
+}
 
-	if len(output) == 0 {
-		return []CommitInfo{}, nil
-	}
+func isShallowRepository() bool {
+	output, err := gitCommand("rev-parse", "--is-shallow-repository").Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
 
-	hashes := strings.Fields(string(output))
-	commits := make([]CommitInfo, 0, len(hashes))
+// commitStream lists the commits to rip, oldest first, reading git
+// rev-list's output as it goes so that huge histories never have to be held
+// in memory at once. Each commit's details are read by getCommitInfo when
+// it is reached.
+type commitStream struct {
+	cmd     *exec.Cmd
+	scanner *bufio.Scanner
+}
 
-	for _, hash := range hashes {
-		commit, err := getCommitInfo(hash)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: failed to get info for commit %s: %v\n", hash, err)
-			continue
+func streamCommitsSince(baseCommit, order string, firstParent bool) (*commitStream, error) {
+	args := []string{"rev-list", "--reverse"}
+	if firstParent {
+		args = append(args, "--first-parent")
+	}
+	if orderFlag := revListOrderFlags[order]; orderFlag != "" {
+		args = append(args, orderFlag)
+	}
+	cmd := gitCommand(append(args, fmt.Sprintf("%s..HEAD", baseCommit))...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &commitStream{cmd: cmd, scanner: bufio.NewScanner(stdout)}, nil
+}
+
+// Next returns the next commit hash, or false once there are none left.
+func (s *commitStream) Next() (string, bool) {
+	for s.scanner.Scan() {
+		if hash := strings.TrimSpace(s.scanner.Text()); hash != "" {
+			return hash, true
 		}
-		commits = append(commits, commit)
 	}
+	return "", false
+}
 
-	return commits, nil
+// Close waits for git rev-list to finish, and reports whether it failed.
+func (s *commitStream) Close() error {
+	if err := s.scanner.Err(); err != nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+		return err
+	}
+	return s.cmd.Wait()
+}
+
+// countCommitsSince returns how many commits there are to rip.
+func countCommitsSince(baseCommit string, firstParent bool) (int, error) {
+	args := []string{"rev-list", "--count"}
+	if firstParent {
+		args = append(args, "--first-parent")
+	}
+	output, err := gitCommand(append(args, baseCommit+"..HEAD")...).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(output)))
 }
 
 func getCommitInfo(hash string) (CommitInfo, error) {
-	cmd := exec.Command("git", "show", "-s", "--format=%H%x00%B%x00%an%x00%ae%x00%at%x00%cn%x00%ce%x00%ct", hash)
+	cmd := gitCommand("show", "-s", "--date=raw", "--format=%H%x00%B%x00%an%x00%ae%x00%at%x00%cn%x00%ce%x00%ct%x00%ad%x00%cd%x00%(trailers:key="+monorepoLocalTrailer+",valueonly)", hash)
 	output, err := cmd.Output()
 	if err != nil {
 		return CommitInfo{}, err
 	}
 
 	parts := strings.Split(strings.TrimSpace(string(output)), "\x00")
-	if len(parts) < 8 {
+	if len(parts) < 11 {
 		return CommitInfo{}, fmt.Errorf("unexpected git show output")
 	}
 
@@ -229,34 +689,77 @@ func getCommitInfo(hash string) (CommitInfo, error) {
 		return CommitInfo{}, err
 	}
 
+	// With --date=raw, %ad and %cd are "<epoch> <offset>"
+	authorDate := strings.Fields(parts[8])
+	committerDate := strings.Fields(parts[9])
+	if len(authorDate) != 2 || len(committerDate) != 2 {
+		return CommitInfo{}, fmt.Errorf("unexpected dates in git show output: %q, %q", parts[8], parts[9])
+	}
+
+	// The trailer may be given more than once, one value per line; any
+	// value that is exactly "true" counts
+	monorepoLocal := false
+	for _, value := range strings.Split(parts[10], "\n") {
+		if strings.EqualFold(strings.TrimSpace(value), "true") {
+			monorepoLocal = true
+		}
+	}
+
 	return CommitInfo{
 		Hash:               parts[0],
-		Message:            strings.TrimSpace(parts[1]),
+		Message:            parts[1],
 		AuthorName:         parts[2],
 		AuthorEmail:        parts[3],
 		AuthorTimestamp:    authorTimestamp,
+		AuthorTimezone:     authorDate[1],
 		CommitterName:      parts[5],
 		CommitterEmail:     parts[6],
 		CommitterTimestamp: committerTimestamp,
+		CommitterTimezone:  committerDate[1],
+		MonorepoLocal:      monorepoLocal,
 	}, nil
 }
 
 func getRemotesFromBaseCommit(baseCommit string) ([]string, error) {
-	cmd := exec.Command("git", "ls-tree", baseCommit)
-	output, err := cmd.Output()
+	recorded, err := getStitchParents(baseCommit)
+	if err != nil {
+		return nil, err
+	}
+	if len(recorded) > 0 {
+		remotes := make([]string, 0, len(recorded))
+		for dir := range recorded {
+			remotes = append(remotes, dir)
+		}
+		sort.Strings(remotes)
+		return remotes, nil
+	}
+
+	parentTrees, err := getParentTrees(baseCommit)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := listSubtrees(baseCommit)
 	if err != nil {
 		return nil, err
 	}
 
 	var remotes []string
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Fields(line)
-		if len(parts) >= 4 && parts[1] == "tree" {
-			// Extract directory name from the tree entry
-			dirName := strings.Join(parts[3:], " ")
-			remotes = append(remotes, dirName)
+	for _, entry := range entries {
+		if len(parentTrees) == 0 || parentTrees[entry.Hash] {
+			remotes = append(remotes, entry.Name)
+			continue
+		}
+		// A remote may have been stitched into a nested directory such as
+		// vendor/libs; look for subtrees that match one of the parents.
+		nested, err := findStitchedDirs(entry.Hash, entry.Name, parentTrees)
+		if err != nil {
+			return nil, err
+		}
+		if len(nested) > 0 {
+			remotes = append(remotes, nested...)
+		} else {
+			remotes = append(remotes, entry.Name)
 		}
 	}
 
@@ -264,9 +767,143 @@ func getRemotesFromBaseCommit(baseCommit string) ([]string, error) {
 	return remotes, nil
 }
 
+// treeEntry is a subtree listed by git ls-tree.
+type treeEntry struct {
+	Name string
+	Hash string
+}
+
+// listSubtrees returns the tree entries directly under treeish.
+func listSubtrees(treeish string) ([]treeEntry, error) {
+	output, err := gitCommand("ls-tree", treeish).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []treeEntry
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		meta, name, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			continue
+		}
+		parts := strings.Fields(meta)
+		if len(parts) == 3 && parts[1] == "tree" {
+			entries = append(entries, treeEntry{Name: name, Hash: parts[2]})
+		}
+	}
+	return entries, nil
+}
+
+// getParentTrees returns the set of tree hashes of the parents of commit.
+func getParentTrees(commit string) (map[string]bool, error) {
+	output, err := gitCommand("show", "-s", "--format=%P", commit).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	trees := make(map[string]bool)
+	for _, parent := range strings.Fields(string(output)) {
+		tree, err := gitCommand("rev-parse", parent+"^{tree}").Output()
+		if err != nil {
+			return nil, err
+		}
+		trees[strings.TrimSpace(string(tree))] = true
+	}
+	return trees, nil
+}
+
+// findStitchedDirs walks the tree at dir and returns the paths of subtrees
+// whose contents match one of parentTrees.
+func findStitchedDirs(tree, dir string, parentTrees map[string]bool) ([]string, error) {
+	entries, err := listSubtrees(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		path := dir + "/" + entry.Name
+		if parentTrees[entry.Hash] {
+			dirs = append(dirs, path)
+			continue
+		}
+		nested, err := findStitchedDirs(entry.Hash, path, parentTrees)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, nested...)
+	}
+	return dirs, nil
+}
+
+// remoteForPath returns the remote directory that contains path, preferring
+// the longest match so nested directories like vendor/libs win over vendor,
+// along with path relative to that directory.
+func remoteForPath(path string, remotes []string) (remote, rest string, ok bool) {
+	for _, dir := range remotes {
+		if strings.HasPrefix(path, dir+"/") && len(dir) > len(remote) {
+			remote = dir
+			rest = path[len(dir)+1:]
+			ok = true
+		}
+	}
+	return remote, rest, ok
+}
+
+// getStitchParents returns the directory to parent commit mapping recorded
+// in the base commit's Stitch-Parent trailers. Base commits made by older
+// versions of git-stitch have none, and the result is empty.
+func getStitchParents(baseCommit string) (map[string]string, error) {
+	format := fmt.Sprintf("--format=%%(trailers:key=%s,valueonly)", stitchParentTrailer)
+	output, err := gitCommand("show", "-s", format, baseCommit).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trailers of base commit %s: %v", baseCommit, err)
+	}
+
+	parents := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			continue
+		}
+		parents[line[:i]] = line[i+1:]
+	}
+	return parents, nil
+}
+
+// getStitchEmpty returns the placeholder directories recorded in the base
+// commit's Stitch-Empty trailers.
+func getStitchEmpty(baseCommit string) ([]string, error) {
+	format := fmt.Sprintf("--format=%%(trailers:key=%s,valueonly)", stitchEmptyTrailer)
+	output, err := gitCommand("show", "-s", format, baseCommit).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trailers of base commit %s: %v", baseCommit, err)
+	}
+
+	// One directory per line. Directory names may contain spaces.
+	var dirs []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			dirs = append(dirs, line)
+		}
+	}
+	return dirs, nil
+}
+
 func getOriginalCommitForRemote(baseCommit, remote string) (string, error) {
+	recorded, err := getStitchParents(baseCommit)
+	if err != nil {
+		return "", err
+	}
+	if parent, ok := recorded[remote]; ok {
+		verbosef("Base commit %s records parent %s for remote %s\n", baseCommit, parent, remote)
+		return parent, nil
+	}
+
 	// Get the parents of the base merge commit
-	cmd := exec.Command("git", "show", "-s", "--format=%P", baseCommit)
+	cmd := gitCommand("show", "-s", "--format=%P", baseCommit)
 	output, err := cmd.Output()
 	if err != nil {
 		return "", fmt.Errorf("failed to get parents of base commit %s: %v", baseCommit, err)
@@ -277,72 +914,62 @@ func getOriginalCommitForRemote(baseCommit, remote string) (string, error) {
 		return "", fmt.Errorf("no parents found for base commit %s", baseCommit)
 	}
 
-	if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-		fmt.Printf("Base commit %s has parents: %v\n", baseCommit, parents)
-	}
+	verbosef("Base commit %s has parents: %v\n", baseCommit, parents)
 
 	// Try to match the remote with the correct parent by checking tree content
 	for i, parent := range parents {
 		// Get the tree from this parent
-		cmd = exec.Command("git", "rev-parse", parent+"^{tree}")
+		cmd = gitCommand("rev-parse", parent+"^{tree}")
 		output, err = cmd.Output()
 		if err != nil {
-			if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-				fmt.Printf("Warning: couldn't get tree for parent %s: %v\n", parent, err)
-			}
+			verbosef("Warning: couldn't get tree for parent %s: %v\n", parent, err)
 			continue
 		}
 		parentTree := strings.TrimSpace(string(output))
 
 		// Get the tree hash for this remote directory in the base commit
-		if os.Getenv("GIT_STITCH_VERBOSE") != "" {
+		if verbose {
 			wd, _ := os.Getwd()
 			fmt.Printf("Running 'git rev-parse %s:%s' in directory %s\n", baseCommit, remote, wd)
 		}
-		cmd = exec.Command("git", "rev-parse", fmt.Sprintf("%s:%s", baseCommit, remote))
+		cmd = gitCommand("rev-parse", fmt.Sprintf("%s:%s", baseCommit, remote))
 		output, err = cmd.Output()
 		if err != nil {
-			if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-				fmt.Printf("Warning: couldn't get tree for remote %s in base commit: %v\n", remote, err)
-			}
+			verbosef("Warning: couldn't get tree for remote %s in base commit: %v\n", remote, err)
 			continue
 		}
 		remoteTree := strings.TrimSpace(string(output))
-		if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-			fmt.Printf("Got tree hash for remote %s: %s\n", remote, remoteTree)
-		}
+		verbosef("Got tree hash for remote %s: %s\n", remote, remoteTree)
 
-		if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-			fmt.Printf("Comparing parent %d (%s) tree %s with remote %s tree %s - match: %t\n", i, parent, parentTree, remote, remoteTree, parentTree == remoteTree)
-		}
+		verbosef("Comparing parent %d (%s) tree %s with remote %s tree %s - match: %t\n", i, parent, parentTree, remote, remoteTree, parentTree == remoteTree)
 		if parentTree == remoteTree {
-			if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-				fmt.Printf("Found matching parent %s for remote %s (trees match: %s)\n", parent, remote, parentTree)
-			}
+			verbosef("Found matching parent %s for remote %s (trees match: %s)\n", parent, remote, parentTree)
 			return parent, nil
 		}
 	}
 
 	// Fallback: return the first parent (this assumes order is preserved)
-	if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-		fmt.Printf("No exact match found for remote %s, using first parent %s\n", remote, parents[0])
-	}
+	verbosef("No exact match found for remote %s, using first parent %s\n", remote, parents[0])
 	return parents[0], nil
 }
 
-func getChangedFiles(commitHash string) ([]string, error) {
-	cmd := exec.Command("git", "diff-tree", "--no-commit-id", "--name-only", "-r", commitHash)
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, err
+// getChangedFilesWithStatus lists the files changed by a commit. Merge
+// commits normally report no changes, since the merged commits are replayed
+// individually. With firstParent, every commit is instead diffed against its
+// first parent, so a merge carries everything its side branch introduced.
+//
+// Renames are always reported as a deletion plus an addition. That is what
+// a move between two remotes needs, and a move within one remote comes out
+// the same once both halves are applied. diff-tree is plumbing and doesn't
+// read diff.renames, so --no-renames only guards against rename detection
+// ever being turned on by default.
+func getChangedFilesWithStatus(commitHash string, firstParent bool) ([]FileChange, error) {
+	args := []string{"diff-tree", "--no-commit-id", "--no-renames", "--name-status", "-r"}
+	if firstParent {
+		args = append(args, commitHash+"^1")
 	}
-
-	files := strings.Fields(string(output))
-	return files, nil
-}
-
-func getChangedFilesWithStatus(commitHash string) ([]FileChange, error) {
-	cmd := exec.Command("git", "diff-tree", "--no-commit-id", "--name-status", "-r", commitHash)
+	args = append(args, commitHash)
+	cmd := gitCommand(args...)
 	output, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -365,101 +992,106 @@ func getChangedFilesWithStatus(commitHash string) ([]FileChange, error) {
 	return changes, nil
 }
 
-func createCommitForRemote(commit CommitInfo, remote string, files []string, parentCommit string) (string, error) {
-	// Much simpler approach: just apply the single file change to the parent tree
-	if len(files) != 1 {
-		return "", fmt.Errorf("expected exactly 1 file, got %d: %v", len(files), files)
-	}
-	file := files[0]
-	monorepoPath := fmt.Sprintf("%s/%s", remote, file)
-
-	// Get the file content from the monorepo commit
-	cmd := exec.Command("git", "show", fmt.Sprintf("%s:%s", commit.Hash, monorepoPath))
-	fileContent, err := cmd.Output()
+// tempIndexes tracks the directories holding in-flight index files so they
+// can be removed if git-rip is interrupted.
+var tempIndexes = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+// newTempIndex returns a path for a GIT_INDEX_FILE inside a fresh directory
+// under os.TempDir(), so concurrent git-rip processes never share an index,
+// along with a function that removes it.
+func newTempIndex() (string, func(), error) {
+	dir, err := os.MkdirTemp("", "git-rip-index-*")
 	if err != nil {
-		return "", fmt.Errorf("failed to get file content for %s: %v", file, err)
+		return "", nil, err
 	}
 
-	// Create a blob for this file content
-	cmd = exec.Command("git", "hash-object", "-w", "--stdin")
-	cmd.Stdin = strings.NewReader(string(fileContent))
-	blobOutput, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to create blob for %s: %v", file, err)
+	tempIndexes.Lock()
+	tempIndexes.dirs[dir] = true
+	tempIndexes.Unlock()
+
+	cleanup := func() {
+		tempIndexes.Lock()
+		delete(tempIndexes.dirs, dir)
+		tempIndexes.Unlock()
+		os.RemoveAll(dir)
 	}
-	blobHash := strings.TrimSpace(string(blobOutput))
+	return filepath.Join(dir, "index"), cleanup, nil
+}
+
+// removeTempIndexesOnSignal removes in-flight index files and exits when
+// git-rip receives SIGINT or SIGTERM.
+func removeTempIndexesOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		tempIndexes.Lock()
+		for dir := range tempIndexes.dirs {
+			os.RemoveAll(dir)
+		}
+		tempIndexes.Unlock()
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+}
 
-	// Get the file mode from the monorepo
-	cmd = exec.Command("git", "ls-tree", commit.Hash, monorepoPath)
-	modeOutput, err := cmd.Output()
+func createCommitForRemoteWithChanges(commit CommitInfo, remote string, fileChanges []FileChange, parentCommit string) (string, error) {
+	// Use git's index to properly handle subdirectories
+	// This is much more robust than trying to manually build trees
+
+	// Create a temporary index file
+	indexFile, cleanup, err := newTempIndex()
 	if err != nil {
-		return "", fmt.Errorf("failed to get mode for %s: %v", file, err)
-	}
-	parts := strings.Fields(strings.TrimSpace(string(modeOutput)))
-	if len(parts) < 1 {
-		return "", fmt.Errorf("invalid ls-tree output for %s", file)
+		return "", fmt.Errorf("failed to create temporary index: %v", err)
 	}
-	mode := parts[0]
+	defer cleanup()
 
-	// Get the parent tree
-	cmd = exec.Command("git", "rev-parse", parentCommit+"^{tree}")
-	parentTreeOutput, err := cmd.Output()
+	// Read the parent tree into the index
+	parentTree, err := gitCommand("rev-parse", parentCommit+"^{tree}").Output()
 	if err != nil {
 		return "", fmt.Errorf("failed to get parent tree: %v", err)
 	}
-	parentTree := strings.TrimSpace(string(parentTreeOutput))
+	parentTreeHash := strings.TrimSpace(string(parentTree))
 
-	// Read the parent tree and add our file
-	cmd = exec.Command("git", "ls-tree", parentTree)
-	treeOutput, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to read parent tree: %v", err)
+	cmd := gitCommand("read-tree", parentTreeHash)
+	cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+indexFile)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to read parent tree into index: %v", err)
 	}
 
-	// Build new tree entries: parent tree + our new file
-	var treeEntries []string
-	scanner := bufio.NewScanner(strings.NewReader(string(treeOutput)))
-	fileExists := false
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "\t", 2)
-		if len(parts) == 2 && parts[1] == file {
-			// Replace existing file
-			treeEntries = append(treeEntries, fmt.Sprintf("%s blob %s\t%s", mode, blobHash, file))
-			fileExists = true
-		} else {
-			// Keep existing entry
-			treeEntries = append(treeEntries, line)
+	// Apply the changes to the index
+	for _, change := range fileChanges {
+		if err := applyChangeToIndex(commit, remote, change, indexFile); err != nil {
+			return "", fmt.Errorf("failed to apply change %s: %v", change.Path, err)
 		}
 	}
 
-	// Add new file if it didn't exist
-	if !fileExists {
-		treeEntries = append(treeEntries, fmt.Sprintf("%s blob %s\t%s", mode, blobHash, file))
-	}
-
-	// Create the new tree
-	treeInput := strings.Join(treeEntries, "\n") + "\n"
-	cmd = exec.Command("git", "mktree")
-	cmd.Stdin = strings.NewReader(treeInput)
+	// Write the tree from the index
+	cmd = gitCommand("write-tree")
+	cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+indexFile)
 	newTreeOutput, err := cmd.Output()
 	if err != nil {
-		return "", fmt.Errorf("failed to create tree: %v", err)
+		return "", fmt.Errorf("failed to write tree from index: %v", err)
 	}
 	newTree := strings.TrimSpace(string(newTreeOutput))
 
-	// Create the commit
-	cmd = exec.Command("git", "commit-tree", newTree, "-p", parentCommit, "-m", commit.Message)
+	verbosef("Created tree %s for %d changes\n", newTree, len(fileChanges))
+
+	// Create the commit. commit-tree is plumbing, so no hooks are run.
+	cmd = gitCommand("commit-tree", newTree, "-p", parentCommit, "-F", "-")
+	cmd.Stdin = strings.NewReader(commit.Message)
 	cmd.Env = append(os.Environ(),
 		fmt.Sprintf("GIT_AUTHOR_NAME=%s", commit.AuthorName),
 		fmt.Sprintf("GIT_AUTHOR_EMAIL=%s", commit.AuthorEmail),
 		fmt.Sprintf("GIT_COMMITTER_NAME=%s", commit.CommitterName),
 		fmt.Sprintf("GIT_COMMITTER_EMAIL=%s", commit.CommitterEmail),
-		fmt.Sprintf("GIT_AUTHOR_DATE=%d", commit.AuthorTimestamp),
-		fmt.Sprintf("GIT_COMMITTER_DATE=%d", commit.CommitterTimestamp),
+		"GIT_AUTHOR_DATE="+commit.AuthorDate(),
+		"GIT_COMMITTER_DATE="+commit.CommitterDate(),
 	)
 
-	commitOutput, err := cmd.CombinedOutput() // Use CombinedOutput to capture stderr
+	commitOutput, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", fmt.Errorf("failed to create commit-tree (parent: %s, tree: %s): %v, output: %s", parentCommit, newTree, err, string(commitOutput))
 	}
@@ -467,150 +1099,50 @@ func createCommitForRemote(commit CommitInfo, remote string, files []string, par
 	return strings.TrimSpace(string(commitOutput)), nil
 }
 
-func createCommitForRemoteWithChanges(commit CommitInfo, remote string, fileChanges []FileChange, parentCommit string) (string, error) {
-	// For now, handle multiple changes by applying them one by one
-	// This is simpler and more reliable than trying to build complex trees
-	currentParent := parentCommit
-
-	for _, change := range fileChanges {
-		// Create a temporary single-file change and apply it
-		newCommit, err := createCommitForRemoteSingleChange(commit, remote, change, currentParent)
-		if err != nil {
-			return "", fmt.Errorf("failed to apply change %s: %v", change.Path, err)
-		}
-		currentParent = newCommit
-	}
-
-	return currentParent, nil
-}
-
-func createCommitForRemoteSingleChange(commit CommitInfo, remote string, change FileChange, parentCommit string) (string, error) {
+// applyChangeToIndex applies a single file change from the monorepo commit to
+// the remote-relative index in indexFile.
+func applyChangeToIndex(commit CommitInfo, remote string, change FileChange, indexFile string) error {
 	filePath := change.Path
 	monorepoPath := fmt.Sprintf("%s/%s", remote, filePath)
 
-	// Use git's index to properly handle subdirectories
-	// This is much more robust than trying to manually build trees
-
-	// Create a temporary index file
-	tmpDir := "/tmp"
-	indexFile := filepath.Join(tmpDir, fmt.Sprintf("git-rip-index-%d", time.Now().UnixNano()))
-	defer os.Remove(indexFile)
-
-	// Read the parent tree into the index
-	parentTree, err := exec.Command("git", "rev-parse", parentCommit+"^{tree}").Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to get parent tree: %v", err)
-	}
-	parentTreeHash := strings.TrimSpace(string(parentTree))
-
-	cmd := exec.Command("git", "read-tree", parentTreeHash)
-	cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+indexFile)
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to read parent tree into index: %v", err)
-	}
-
-	// Apply the change to the index
 	switch change.Status {
 	case "D": // Deletion
-		cmd = exec.Command("git", "update-index", "--remove", filePath)
+		cmd := gitCommand("update-index", "--remove", filePath)
 		cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+indexFile)
 		if err := cmd.Run(); err != nil {
-			return "", fmt.Errorf("failed to remove file from index: %v", err)
-		}
-		if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-			fmt.Printf("Removed %s from index\n", filePath)
+			return fmt.Errorf("failed to remove file from index: %v", err)
 		}
+		verbosef("Removed %s from index\n", filePath)
 
-	case "A", "M": // Addition or Modification
-		// Get the blob hash from the monorepo
-		blobHash, err := exec.Command("git", "rev-parse", fmt.Sprintf("%s:%s", commit.Hash, monorepoPath)).Output()
+	case "A", "M", "T": // Addition, Modification, or type change
+		// Get the blob hash from the monorepo. For a submodule this is the
+		// commit its gitlink points to, which git-rip doesn't need to have,
+		// and the 160000 mode below keeps it a gitlink.
+		blobHash, err := gitCommand("rev-parse", fmt.Sprintf("%s:%s", commit.Hash, monorepoPath)).Output()
 		if err != nil {
-			return "", fmt.Errorf("failed to get blob hash for %s: %v", monorepoPath, err)
+			return fmt.Errorf("failed to get blob hash for %s: %v", monorepoPath, err)
 		}
 		blobHashStr := strings.TrimSpace(string(blobHash))
 
 		// Get the file mode from the monorepo
-		modeOutput, err := exec.Command("git", "ls-tree", commit.Hash, monorepoPath).Output()
+		modeOutput, err := gitCommand("ls-tree", commit.Hash, monorepoPath).Output()
 		if err != nil {
-			return "", fmt.Errorf("failed to get mode for %s: %v", monorepoPath, err)
+			return fmt.Errorf("failed to get mode for %s: %v", monorepoPath, err)
 		}
 		parts := strings.Fields(strings.TrimSpace(string(modeOutput)))
 		if len(parts) < 1 {
-			return "", fmt.Errorf("invalid ls-tree output for %s", monorepoPath)
+			return fmt.Errorf("invalid ls-tree output for %s", monorepoPath)
 		}
 		mode := parts[0]
 
 		// Add/update the file in the index
-		cmd = exec.Command("git", "update-index", "--add", "--cacheinfo", mode, blobHashStr, filePath)
+		cmd := gitCommand("update-index", "--add", "--cacheinfo", mode, blobHashStr, filePath)
 		cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+indexFile)
 		if err := cmd.Run(); err != nil {
-			return "", fmt.Errorf("failed to update index for %s: %v", filePath, err)
-		}
-		if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-			fmt.Printf("Updated %s in index with mode %s and blob %s\n", filePath, mode, blobHashStr)
+			return fmt.Errorf("failed to update index for %s: %v", filePath, err)
 		}
+		verbosef("Updated %s in index with mode %s and blob %s\n", filePath, mode, blobHashStr)
 	}
 
-	// Write the tree from the index
-	cmd = exec.Command("git", "write-tree")
-	cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+indexFile)
-	newTreeOutput, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to write tree from index: %v", err)
-	}
-	newTree := strings.TrimSpace(string(newTreeOutput))
-
-	if os.Getenv("GIT_STITCH_VERBOSE") != "" {
-		fmt.Printf("Created tree %s for change %s %s\n", newTree, change.Status, filePath)
-	}
-
-	// Create the commit
-	cmd = exec.Command("git", "commit-tree", newTree, "-p", parentCommit, "-m", commit.Message)
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("GIT_AUTHOR_NAME=%s", commit.AuthorName),
-		fmt.Sprintf("GIT_AUTHOR_EMAIL=%s", commit.AuthorEmail),
-		fmt.Sprintf("GIT_COMMITTER_NAME=%s", commit.CommitterName),
-		fmt.Sprintf("GIT_COMMITTER_EMAIL=%s", commit.CommitterEmail),
-		fmt.Sprintf("GIT_AUTHOR_DATE=%d", commit.AuthorTimestamp),
-		fmt.Sprintf("GIT_COMMITTER_DATE=%d", commit.CommitterTimestamp),
-	)
-
-	commitOutput, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("failed to create commit-tree (parent: %s, tree: %s): %v, output: %s", parentCommit, newTree, err, string(commitOutput))
-	}
-
-	return strings.TrimSpace(string(commitOutput)), nil
-}
-
-func createBlobAndGetMode(commitHash, monorepoPath string) (string, string, error) {
-	// Get the file content from the monorepo commit
-	cmd := exec.Command("git", "show", fmt.Sprintf("%s:%s", commitHash, monorepoPath))
-	fileContent, err := cmd.Output()
-	if err != nil {
-		return "", "", fmt.Errorf("failed to get file content for %s: %v", monorepoPath, err)
-	}
-
-	// Create a blob for this file content
-	cmd = exec.Command("git", "hash-object", "-w", "--stdin")
-	cmd.Stdin = strings.NewReader(string(fileContent))
-	blobOutput, err := cmd.Output()
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create blob for %s: %v", monorepoPath, err)
-	}
-	blobHash := strings.TrimSpace(string(blobOutput))
-
-	// Get the file mode from the monorepo
-	cmd = exec.Command("git", "ls-tree", commitHash, monorepoPath)
-	modeOutput, err := cmd.Output()
-	if err != nil {
-		return "", "", fmt.Errorf("failed to get mode for %s: %v", monorepoPath, err)
-	}
-	parts := strings.Fields(strings.TrimSpace(string(modeOutput)))
-	if len(parts) < 1 {
-		return "", "", fmt.Errorf("invalid ls-tree output for %s", monorepoPath)
-	}
-	mode := parts[0]
-
-	return blobHash, mode, nil
+	return nil
 }
@@ -1,106 +1,266 @@
 package main
 
 import (
-	"debug/buildinfo"
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/philz/git-stitch/internal/version"
 )
 
-func getBuildInfo() string {
-	if info, err := buildinfo.ReadFile(os.Args[0]); err == nil {
-		if info.Main.Sum != "" {
-			return fmt.Sprintf("%s (%s)", info.Main.Version, info.Main.Sum)
-		}
-		return info.Main.Version
+// Exit codes, so that scripts can tell kinds of failure apart. Any other
+// failure exits with 1.
+const (
+	exitUsage         = 2 // bad command-line arguments
+	exitNotConfigured = 3 // a remote or ref doesn't exist
+	exitGitFailure    = 4 // a git command failed
+)
+
+// stitchParentTrailer names the trailer that records, for each directory of
+// the base commit, the parent commit it was stitched from. git-rip reads it.
+const stitchParentTrailer = "Stitch-Parent"
+
+// stitchBaseTrailer names the trailer carrying stitch.base-marker, which is
+// what git-rip searches for, so the subject can say whatever it likes.
+const stitchBaseTrailer = "Stitch-Base"
+
+// stitchEmptyTrailer names the trailer that records each -empty placeholder
+// directory, which has no remote behind it. git-rip leaves these alone.
+const stitchEmptyTrailer = "Stitch-Empty"
+
+// defaultBaseMarker is the base commit's marker when stitch.base-marker is
+// unset. It is also the default subject, as base commits once had no marker.
+const defaultBaseMarker = "git-stitch merge"
+
+var (
+	errBadRefFormat = errors.New("ref must be in format 'remote/branch'")
+	errNoSuchRemote = errors.New("no such remote")
+	errNoSuchRef    = errors.New("no such commit")
+)
+
+// exitCodeFor maps an error from resolveRef to the process's exit code.
+func exitCodeFor(err error) int {
+	switch {
+	case errors.Is(err, errBadRefFormat):
+		return exitUsage
+	case errors.Is(err, errNoSuchRemote), errors.Is(err, errNoSuchRef):
+		return exitNotConfigured
+	default:
+		return exitGitFailure
+	}
+}
+
+// verbose enables diagnostic output. It defaults to on when
+// GIT_STITCH_VERBOSE is set, and the -v flag overrides that either way.
+var verbose = os.Getenv("GIT_STITCH_VERBOSE") != ""
+
+func verbosef(format string, args ...any) {
+	if verbose {
+		fmt.Printf(format, args...)
 	}
-	return "dev (unknown)"
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "git-stitch %s\n", getBuildInfo())
+	flag.BoolVar(&verbose, "v", verbose, "print diagnostic output (also enabled by GIT_STITCH_VERBOSE)")
+	flag.BoolVar(&verbose, "verbose", verbose, "same as -v")
+	noFetch := flag.Bool("no-fetch", false, "don't fetch remotes before resolving refs")
+	unshallow := flag.Bool("unshallow", false, "fetch complete history if this repository is shallow")
+	var gitConfig configFlag
+	flag.Var(&gitConfig, "git-config", "`key=value` git config to use when fetching, like git -c (repeatable)")
+	validate := flag.Bool("validate", false, "resolve and report refs without creating a commit")
+	maxBlobSize := flag.Int64("max-blob-size", 0, "fail if any blob is larger than this many bytes (0 only warns about very large blobs)")
+	treeFilter := flag.String("tree-filter", "", "shell command to run in a checkout of each remote's tree before stitching it")
+	stats := flag.Bool("stats", false, "report blob counts and sizes per remote and exit without creating a commit")
+	sign := flag.Bool("sign", getConfigBool("stitch.sign"), "GPG-sign the merge commit (also enabled by stitch.sign)")
+	message := flag.String("m", defaultBaseMarker, "subject of the merge commit")
+	var dirOverrides configFlag
+	flag.Var(&dirOverrides, "dir", "`remote=dir` stitches remote into dir instead of a directory named after it (repeatable)")
+	allowCaseCollisions := flag.Bool("allow-case-collisions", false, "warn about paths that differ only in case instead of failing")
+	noParents := flag.Bool("no-parents", false, "create a parentless root commit that doesn't reference the remotes' histories (git-rip can't split it)")
+	jobs := flag.Int("jobs", 1, "fetch up to this many remotes at once")
+	check := flag.Bool("check", false, "build the commit twice, without writing to the repository, and fail unless both builds match")
+	strict := flag.Bool("strict", false, "fail, rather than warn, when remotes share history")
+	var emptyDirFlags listFlag
+	flag.Var(&emptyDirFlags, "empty", "reserve `dir` with an empty .gitkeep, for a remote that doesn't exist yet (repeatable)")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	primary := flag.String("primary", "", "make this remote's commit the first parent (default: the first remote in sorted order)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "git-stitch %s\n", version.String())
 		fmt.Fprintf(os.Stderr, "Combines multiple repositories into a monorepo structure.\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: git-stitch [-no-fetch] ref1 [ref2...]\n")
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Usage: git-stitch [-v] [-no-fetch] [-unshallow] [-jobs <n>] [-git-config <key=value>]... [-strict] [-validate] [-check] [-stats] [-allow-case-collisions] [-max-blob-size <bytes>] [-m <subject>] [-primary <remote> | -no-parents] [-dir <remote=dir>]... [-empty <dir>]... [-sign] [-tree-filter <cmd>] ref1 [ref2...]\n       git-stitch [flags] - < refs\n       git-stitch -version\n\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExit codes: %d usage error, %d missing remote or ref, %d git failure, 1 anything else\n",
+			exitUsage, exitNotConfigured, exitGitFailure)
+	}
+	if len(os.Args) < 2 && !stdinIsPiped() {
+		flag.Usage()
+		os.Exit(exitUsage)
 	}
+	flag.Parse()
 
-	noFetch := false
-	args := os.Args[1:]
-	if len(args) > 0 && args[0] == "-no-fetch" {
-		noFetch = true
-		args = args[1:]
+	if *showVersion {
+		fmt.Printf("git-stitch %s\n", version.String())
+		return
 	}
 
-	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "Error: No refs specified\n")
-		os.Exit(1)
+	// Refs can come from stdin, one per line, for more than fit on a
+	// command line
+	args := flag.Args()
+	if len(args) == 0 && stdinIsPiped() {
+		args = []string{"-"}
+	}
+	refs, err := expandStdinRefs(args, os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading refs from stdin: %v\n", err)
+		os.Exit(exitUsage)
 	}
 
-	refs := args
+	if len(refs) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No refs specified\n")
+		os.Exit(exitUsage)
+	}
+	if *jobs < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -jobs must be at least 1\n")
+		os.Exit(exitUsage)
+	}
 
-	// Parse remote/branch format and fetch if needed
+	// Parse remote/branch format and fetch if needed. Every ref is resolved
+	// even if an earlier one fails so that all problems are reported at once.
 	remoteCommits := make(map[string]string)
 	maxTimestamp := int64(0)
+	var failedRefs []string
+	failureCode := 0
 
-	for _, ref := range refs {
-		parts := strings.SplitN(ref, "/", 2)
-		if len(parts) != 2 {
-			fmt.Fprintf(os.Stderr, "Error: ref %s must be in format 'remote/branch'\n", ref)
-			os.Exit(1)
-		}
-		remote := parts[0]
-		_ = parts[1] // branch name, used in ref but not needed separately
-
-		// Check if remote exists
-		cmd := exec.Command("git", "remote", "get-url", remote)
-		if err := cmd.Run(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: remote '%s' does not exist\n", remote)
-			os.Exit(1)
-		}
+	// Refs are resolved, and their remotes fetched, -jobs at a time. Each
+	// ref's output is buffered and printed in order once it's done, so that
+	// concurrent fetches don't interleave.
+	type refResult struct {
+		resolved       ResolvedRef
+		err            error
+		stdout, stderr bytes.Buffer
+		done           chan struct{}
+	}
+	results := make([]*refResult, len(refs))
+	fetch := fetchOptions{Skip: *noFetch, Unshallow: *unshallow, Config: gitConfig, Concurrent: *jobs > 1}
+	slots := make(chan struct{}, *jobs)
+	for i, ref := range refs {
+		result := &refResult{done: make(chan struct{})}
+		results[i] = result
+		go func() {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			defer close(result.done)
+			result.resolved, result.err = resolveRef(ref, fetch, &result.stdout, &result.stderr)
+		}()
+	}
 
-		if !noFetch {
-			fmt.Printf("Fetching %s... ", remote)
-			cmd := exec.Command("git", "fetch", remote)
-			if err := cmd.Run(); err != nil {
-				fmt.Fprintf(os.Stderr, "Error fetching %s: %v\n", remote, err)
-				os.Exit(1)
+	for i, ref := range refs {
+		result := results[i]
+		<-result.done
+		os.Stdout.Write(result.stdout.Bytes())
+		os.Stderr.Write(result.stderr.Bytes())
+		resolved, err := result.resolved, result.err
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", ref, err)
+			failedRefs = append(failedRefs, ref)
+			if failureCode == 0 {
+				failureCode = exitCodeFor(err)
 			}
+			continue
+		}
+		remoteCommits[resolved.Remote] = resolved.Commit
+		fmt.Printf("%s is %s\n", ref, resolved.Commit)
+		if resolved.Timestamp > maxTimestamp {
+			maxTimestamp = resolved.Timestamp
 		}
+	}
 
-		// Get the commit hash
-		cmd = exec.Command("git", "rev-parse", ref)
-		output, err := cmd.Output()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error getting commit for %s: %v\n", ref, err)
-			os.Exit(1)
+	if len(failedRefs) > 0 {
+		fmt.Fprintf(os.Stderr, "Error: failed to resolve %d of %d refs: %s\n", len(failedRefs), len(refs), strings.Join(failedRefs, ", "))
+		os.Exit(failureCode)
+	}
+
+	if isShallowRepository() {
+		fmt.Fprintf(os.Stderr, "Warning: this repository is shallow, so history before the shallow boundary is missing\n")
+		fmt.Fprintf(os.Stderr, "Commands that walk history, like git log or git-rip, may not see all of it; use -unshallow to fetch it\n")
+	}
+
+	if *noParents && *primary != "" {
+		fmt.Fprintf(os.Stderr, "Error: -primary has no effect with -no-parents\n")
+		os.Exit(exitUsage)
+	}
+	if _, ok := remoteCommits[*primary]; *primary != "" && !ok {
+		fmt.Fprintf(os.Stderr, "Error: -primary %s is not one of the remotes being stitched\n", *primary)
+		os.Exit(exitUsage)
+	}
+
+	dirs, emptyDirs, err := stitchDirs(remoteCommits, dirOverrides, emptyDirFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	// Remotes that share history, like forks of one project, stitch fine
+	// but hold the shared content twice, which is rarely what was meant
+	overlaps, err := findSharedHistory(remoteCommits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitGitFailure)
+	}
+	for _, overlap := range overlaps {
+		if *strict {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", overlap)
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", overlap)
 		}
-		commitHash := strings.TrimSpace(string(output))
-		remoteCommits[remote] = commitHash
-		fmt.Printf("%s is %s\n", ref, commitHash)
+	}
+	if len(overlaps) > 0 && *strict {
+		os.Exit(1)
+	}
+
+	if *validate {
+		fmt.Printf("All %d refs resolved\n", len(refs))
+		return
+	}
 
-		// Get the commit timestamp to find the maximum
-		cmd = exec.Command("git", "show", "-s", "--format=%ct", commitHash)
-		output, err = cmd.Output()
+	var scratchDir, objectsDir string
+	if *check {
+		if *sign {
+			fmt.Fprintf(os.Stderr, "Error: -check can't be used with -sign, since signatures differ from run to run\n")
+			os.Exit(exitUsage)
+		}
+		scratchDir, err = os.MkdirTemp("", "git-stitch-check-*")
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error getting timestamp for %s: %v\n", commitHash, err)
+			fmt.Fprintf(os.Stderr, "Error: failed to create temporary directory: %v\n", err)
 			os.Exit(1)
 		}
-		timestamp, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+		defer os.RemoveAll(scratchDir)
+		output, err := exec.Command("git", "rev-parse", "--path-format=absolute", "--git-path", "objects").Output()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing timestamp for %s: %v\n", commitHash, err)
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "Error: failed to find the object directory: %v\n", err)
+			os.Exit(exitGitFailure)
 		}
-		if timestamp > maxTimestamp {
-			maxTimestamp = timestamp
+		objectsDir = strings.TrimSpace(string(output))
+		if err := useScratchObjects(filepath.Join(scratchDir, "first"), objectsDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
 	}
 
 	// Create the synthetic tree
-	treeEntries := []string{}
+	remoteTrees := make(map[string]string)
 
 	// Sort remotes for deterministic output
 	remotes := make([]string, 0, len(remoteCommits))
@@ -109,6 +269,7 @@ func main() {
 	}
 	sort.Strings(remotes)
 
+	var total blobStats
 	for _, remote := range remotes {
 		commitHash := remoteCommits[remote]
 		// Get the tree hash for this commit
@@ -116,52 +277,851 @@ func main() {
 		output, err := cmd.Output()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error getting tree for %s: %v\n", commitHash, err)
-			os.Exit(1)
+			os.Exit(exitGitFailure)
 		}
 		treeHash := strings.TrimSpace(string(output))
-		treeEntries = append(treeEntries, fmt.Sprintf("040000 tree %s\t%s", treeHash, remote))
+		if *treeFilter != "" {
+			treeHash, err = filterTree(remote, treeHash, *treeFilter)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		remoteTrees[dirs[remote]] = treeHash
+		verbosef("Remote %s has tree %s\n", remote, treeHash)
+
+		remoteStats, err := checkBlobs(dirs[remote], treeHash, *maxBlobSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if *stats {
+			fmt.Printf("%s: %d blobs, %d bytes\n", remote, remoteStats.Blobs, remoteStats.Size)
+			total.Blobs += remoteStats.Blobs
+			total.Size += remoteStats.Size
+		}
+	}
+
+	if len(emptyDirs) > 0 {
+		emptyTree, err := placeholderTree()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitGitFailure)
+		}
+		for _, dir := range emptyDirs {
+			remoteTrees[dir] = emptyTree
+		}
 	}
 
 	// Create the tree
-	cmd := exec.Command("git", "mktree")
-	cmd.Stdin = strings.NewReader(strings.Join(treeEntries, "\n") + "\n")
-	output, err := cmd.Output()
+	treeHash, err := mktreeNested(remoteTrees)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating tree: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitGitFailure)
 	}
-	treeHash := strings.TrimSpace(string(output))
+	verbosef("Created tree %s\n", treeHash)
 
-	// Prepare commit arguments
-	commitArgs := []string{"commit-tree", treeHash, "-m", "git-stitch merge"}
+	// Paths that differ only in case can't both be checked out on
+	// case-insensitive filesystems, and one silently overwrites the other
+	collisions, err := findCaseCollisions(treeHash)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitGitFailure)
+	}
+	for _, paths := range collisions {
+		if *allowCaseCollisions {
+			fmt.Fprintf(os.Stderr, "Warning: paths differ only in case: %s\n", strings.Join(paths, ", "))
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: paths differ only in case: %s\n", strings.Join(paths, ", "))
+		}
+	}
+	if len(collisions) > 0 && !*allowCaseCollisions {
+		fmt.Fprintf(os.Stderr, "These can't be checked out on case-insensitive filesystems; use -allow-case-collisions to stitch anyway\n")
+		os.Exit(1)
+	}
 
-	// Add parent commits (sorted for determinism)
-	for _, remote := range remotes {
-		commitHash := remoteCommits[remote]
-		commitArgs = append(commitArgs, "-p", commitHash)
-	}
-
-	// Create the commit with deterministic timestamp and author
-	cmd = exec.Command("git", commitArgs...)
-	cmd.Env = append(os.Environ(),
-		"GIT_AUTHOR_NAME=git-stitch",
-		"GIT_AUTHOR_EMAIL=git-stitch@localhost",
-		"GIT_COMMITTER_NAME=git-stitch",
-		"GIT_COMMITTER_EMAIL=git-stitch@localhost",
-		fmt.Sprintf("GIT_AUTHOR_DATE=%d", maxTimestamp),
-		fmt.Sprintf("GIT_COMMITTER_DATE=%d", maxTimestamp),
-	)
+	if *stats {
+		fmt.Printf("Total: %d blobs, %d bytes in tree %s\n", total.Blobs, total.Size, treeHash)
+		return
+	}
 
-	output, err = cmd.Output()
+	commitOpts := commitOptions{
+		Message:   *message,
+		Primary:   *primary,
+		NoParents: *noParents,
+		Sign:      *sign,
+		Timestamp: maxTimestamp,
+		EmptyDirs: emptyDirs,
+	}
+	commitHash, err := createStitchCommit(treeHash, remotes, remoteCommits, dirs, commitOpts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating commit: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitGitFailure)
+	}
+
+	if *check {
+		// Build everything again, into fresh objects and in another
+		// timezone, which would show up anything that leaks into the hash
+		if err := useScratchObjects(filepath.Join(scratchDir, "second"), objectsDir, filepath.Join(scratchDir, "first")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		commitOpts.Env = []string{"TZ=" + checkTimezone}
+		secondTree, err := mktreeNested(remoteTrees)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating tree: %v\n", err)
+			os.Exit(exitGitFailure)
+		}
+		secondCommit, err := createStitchCommit(secondTree, remotes, remoteCommits, dirs, commitOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating commit: %v\n", err)
+			os.Exit(exitGitFailure)
+		}
+		os.RemoveAll(scratchDir)
+		if secondTree != treeHash || secondCommit != commitHash {
+			fmt.Fprintf(os.Stderr, "Error: stitching isn't deterministic: the first build made commit %s with tree %s, the second commit %s with tree %s\n",
+				commitHash, treeHash, secondCommit, secondTree)
+			os.Exit(1)
+		}
+		fmt.Printf("Stitching %s is deterministic: both builds made %s\n", strings.Join(remotes, " & "), commitHash)
+		return
+	}
+
+	if *sign {
+		verifyOutput, err := exec.Command("git", "verify-commit", commitHash).CombinedOutput()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: signature on %s doesn't verify: %v\n%s", commitHash, err, verifyOutput)
+			os.Exit(exitGitFailure)
+		}
+		verbosef("Verified signature on %s\n", commitHash)
 	}
-	commitHash := strings.TrimSpace(string(output))
 
 	fmt.Printf("Stitched %s into %s\n", strings.Join(remotes, " & "), commitHash)
+	if isBareRepository() {
+		// Everything above is plumbing, but checkout and reset need a worktree
+		fmt.Printf("To point a branch at the new commit, run:\n")
+		fmt.Printf("  git update-ref refs/heads/mono %s\n", commitHash)
+		return
+	}
 	fmt.Printf("To check out the new commit, run:\n")
 	fmt.Printf("  git checkout -b mono %s\n", commitHash)
 	fmt.Printf("Or to update your current branch:\n")
 	fmt.Printf("  git reset %s\n", commitHash)
 }
+
+// commitOptions holds the settings createStitchCommit needs from the
+// command line.
+type commitOptions struct {
+	Message   string
+	Primary   string
+	NoParents bool
+	Sign      bool
+	Timestamp int64    // the author and committer date
+	EmptyDirs []string // -empty placeholders
+	Env       []string // added to git commit-tree's environment
+}
+
+// createStitchCommit creates the merge commit for treeHash, with a parent
+// and a Stitch-Parent trailer for each remote. Everything that goes into it
+// is fixed, so the same inputs always give the same commit.
+func createStitchCommit(treeHash string, remotes []string, remoteCommits, dirs map[string]string, opts commitOptions) (string, error) {
+	// Record which parent each directory came from so git-rip doesn't have
+	// to guess by comparing trees, which is ambiguous when two remotes have
+	// identical contents. A -no-parents commit keeps only the marker, so as
+	// not to mention the commits it leaves out.
+	trailers := []string{fmt.Sprintf("%s: %s", stitchBaseTrailer, getConfig("stitch.base-marker", defaultBaseMarker))}
+	if !opts.NoParents {
+		for _, remote := range remotes {
+			trailers = append(trailers, fmt.Sprintf("%s: %s %s", stitchParentTrailer, dirs[remote], remoteCommits[remote]))
+		}
+	}
+	for _, dir := range opts.EmptyDirs {
+		trailers = append(trailers, fmt.Sprintf("%s: %s", stitchEmptyTrailer, dir))
+	}
+
+	// Prepare commit arguments
+	commitArgs := []string{"commit-tree", treeHash, "-m", opts.Message, "-m", strings.Join(trailers, "\n")}
+
+	// Add parent commits, the primary remote first so that first-parent
+	// history follows it, and the rest sorted for determinism
+	if opts.Primary != "" {
+		commitArgs = append(commitArgs, "-p", remoteCommits[opts.Primary])
+	}
+	for _, remote := range remotes {
+		if remote == opts.Primary || opts.NoParents {
+			continue
+		}
+		commitArgs = append(commitArgs, "-p", remoteCommits[remote])
+	}
+
+	// A signature makes the commit hash differ from run to run, even though
+	// the tree and parents stay the same
+	if opts.Sign {
+		commitArgs = append(commitArgs, "-S"+getConfig("stitch.signing-key", ""))
+	}
+
+	// Create the commit with deterministic timestamp and author. Like all
+	// plumbing, commit-tree never runs hooks, so the result doesn't depend on
+	// core.hooksPath or whatever hooks happen to be installed.
+	authorName := getConfig("stitch.author-name", "git-stitch")
+	authorEmail := getConfig("stitch.author-email", "git-stitch@localhost")
+	verbosef("Committing as %s <%s> at %d: git %s\n", authorName, authorEmail, opts.Timestamp, strings.Join(commitArgs, " "))
+	cmd := exec.Command("git", commitArgs...)
+	cmd.Env = append(os.Environ(), opts.Env...)
+	cmd.Env = append(cmd.Env,
+		"GIT_AUTHOR_NAME="+authorName,
+		"GIT_AUTHOR_EMAIL="+authorEmail,
+		"GIT_COMMITTER_NAME="+authorName,
+		"GIT_COMMITTER_EMAIL="+authorEmail,
+		// An explicit UTC offset keeps git from using the local timezone,
+		// which would make the hash depend on $TZ
+		fmt.Sprintf("GIT_AUTHOR_DATE=%d +0000", opts.Timestamp),
+		fmt.Sprintf("GIT_COMMITTER_DATE=%d +0000", opts.Timestamp),
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// checkTimezone is the timezone -check makes its second build in. Its odd
+// offset, +12:45, is unlikely to match the local one by accident.
+const checkTimezone = "Pacific/Chatham"
+
+// useScratchObjects points every git command run from now on at dir for
+// writing objects, reading the objects in alternates as well. -check uses it
+// to leave the repository untouched.
+func useScratchObjects(dir string, alternates ...string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create scratch object directory: %v", err)
+	}
+	os.Setenv("GIT_OBJECT_DIRECTORY", dir)
+	os.Setenv("GIT_ALTERNATE_OBJECT_DIRECTORIES", strings.Join(alternates, string(filepath.ListSeparator)))
+	return nil
+}
+
+// ResolvedRef is a ref given on the command line, resolved to a commit.
+type ResolvedRef struct {
+	Ref       string
+	Remote    string
+	Commit    string
+	Timestamp int64
+}
+
+// remoteForRef returns the remote part of a remote/branch ref. Remote names
+// may themselves contain slashes, so the longest configured remote that ref
+// starts with wins; otherwise the remote is everything before the first slash.
+func remoteForRef(ref string) (string, error) {
+	first, _, ok := strings.Cut(ref, "/")
+	if !ok {
+		return "", errBadRefFormat
+	}
+
+	output, err := exec.Command("git", "remote").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list remotes: %v", err)
+	}
+	remote := first
+	for _, name := range strings.Fields(string(output)) {
+		if strings.HasPrefix(ref, name+"/") && len(name) > len(remote) {
+			remote = name
+		}
+	}
+	return remote, nil
+}
+
+// stdinIsPiped reports whether stdin is a pipe or file rather than a
+// terminal.
+func stdinIsPiped() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice == 0
+}
+
+// expandStdinRefs replaces a "-" in args with the refs read from stdin, one
+// per line. Blank lines and lines starting with # are skipped.
+func expandStdinRefs(args []string, stdin io.Reader) ([]string, error) {
+	var refs []string
+	for _, arg := range args {
+		if arg != "-" {
+			refs = append(refs, arg)
+			continue
+		}
+		if stdin == nil {
+			return nil, errors.New("- given more than once")
+		}
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				refs = append(refs, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		stdin = nil
+	}
+	return refs, nil
+}
+
+// fetchOptions controls how resolveRef fetches remotes.
+type fetchOptions struct {
+	Skip       bool     // -no-fetch
+	Unshallow  bool     // -unshallow
+	Config     []string // -git-config entries, passed to git fetch as -c
+	Concurrent bool     // other fetches may run at the same time, for -jobs
+}
+
+// fetchLocks holds a *sync.Mutex per remote, so that two refs from the same
+// remote are never fetched at once. Unshallowing locks the whole repository,
+// so those fetches all share the "" lock.
+var fetchLocks sync.Map
+
+func (o fetchOptions) lock(remote string) func() {
+	if o.Unshallow {
+		remote = ""
+	}
+	mu, _ := fetchLocks.LoadOrStore(remote, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// command returns a git fetch command with args and the configured -c
+// entries, which apply to this invocation only.
+func (o fetchOptions) command(args ...string) *exec.Cmd {
+	var gitArgs []string
+	for _, entry := range o.Config {
+		gitArgs = append(gitArgs, "-c", entry)
+	}
+	gitArgs = append(gitArgs, "fetch")
+	if o.Concurrent {
+		// Every fetch would otherwise rewrite the same FETCH_HEAD
+		gitArgs = append(gitArgs, "--no-write-fetch-head")
+	}
+	return exec.Command("git", append(gitArgs, args...)...)
+}
+
+// configFlag collects the values of a repeatable key=value flag.
+type configFlag []string
+
+func (c *configFlag) String() string { return strings.Join(*c, ", ") }
+
+func (c *configFlag) Set(value string) error {
+	if key, _, ok := strings.Cut(value, "="); !ok || key == "" {
+		return fmt.Errorf("%q isn't in key=value form", value)
+	}
+	*c = append(*c, value)
+	return nil
+}
+
+// listFlag collects the values of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ", ") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// commitHashPattern matches a full SHA-1 or SHA-256 commit hash.
+var commitHashPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// resolveRef checks that the ref's remote exists, fetches it unless told not
+// to, and resolves the ref to a commit and its committer timestamp. Progress
+// and warnings go to stdout and stderr.
+func resolveRef(ref string, fetch fetchOptions, stdout, stderr io.Writer) (ResolvedRef, error) {
+	remote, err := remoteForRef(ref)
+	if err != nil {
+		return ResolvedRef{}, err
+	}
+
+	// Check if remote exists
+	cmd := exec.Command("git", "remote", "get-url", remote)
+	if err := cmd.Run(); err != nil {
+		return ResolvedRef{}, fmt.Errorf("%w: remote '%s' does not exist", errNoSuchRemote, remote)
+	}
+
+	if !fetch.Skip {
+		defer fetch.lock(remote)()
+		fmt.Fprintf(stdout, "Fetching %s... ", remote)
+		args := []string{remote}
+		if fetch.Unshallow && isShallowRepository() {
+			// --unshallow is an error in a complete repository
+			args = append(args, "--unshallow")
+		}
+		cmd := fetch.command(args...)
+		if err := cmd.Run(); err != nil {
+			return ResolvedRef{}, fmt.Errorf("error fetching %s: %v", remote, err)
+		}
+	}
+
+	// A full commit hash after the remote, as in repo1/<sha>, pins the
+	// remote to that commit rather than naming a remote-tracking ref
+	branch := strings.TrimPrefix(ref, remote+"/")
+	target := ref
+	if commitHashPattern.MatchString(branch) {
+		target = branch
+	}
+
+	// Get the commit hash, peeling annotated tags so that timestamps and
+	// parents refer to the tagged commit rather than the tag object.
+	cmd = exec.Command("git", "rev-parse", "--verify", "--quiet", target+"^{commit}")
+	output, err := cmd.Output()
+	if err != nil && !fetch.Skip {
+		if target == branch {
+			// Only servers that allow fetching by hash will have it
+			if fetchErr := fetch.command(remote, branch).Run(); fetchErr != nil {
+				return ResolvedRef{}, fmt.Errorf("%w: commit %s isn't in this repository, and fetching it from %s failed: %v", errNoSuchRef, branch, remote, fetchErr)
+			}
+		} else {
+			// A narrow remote.<name>.fetch refspec may not cover the branch, so
+			// fetch it into its usual remote-tracking ref explicitly
+			refspec := fmt.Sprintf("+refs/heads/%s:refs/remotes/%s", branch, ref)
+			if fetchErr := fetch.command(remote, refspec).Run(); fetchErr != nil {
+				return ResolvedRef{}, fmt.Errorf("%w: %s isn't a remote-tracking ref, and fetching refs/heads/%s from %s failed: %v", errNoSuchRef, ref, branch, remote, fetchErr)
+			}
+			fmt.Fprintf(stderr, "Warning: %s's fetch refspec doesn't cover %s, so it was fetched explicitly\n", remote, ref)
+		}
+		output, err = exec.Command("git", "rev-parse", "--verify", "--quiet", target+"^{commit}").Output()
+	}
+	if err != nil {
+		return ResolvedRef{}, fmt.Errorf("%w: %v", errNoSuchRef, err)
+	}
+	commitHash := strings.TrimSpace(string(output))
+
+	// Get the commit timestamp to find the maximum
+	cmd = exec.Command("git", "show", "-s", "--format=%ct", commitHash)
+	output, err = cmd.Output()
+	if err != nil {
+		return ResolvedRef{}, fmt.Errorf("error getting timestamp for %s: %v", commitHash, err)
+	}
+	timestamp, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return ResolvedRef{}, fmt.Errorf("error parsing timestamp for %s: %v", commitHash, err)
+	}
+
+	return ResolvedRef{Ref: ref, Remote: remote, Commit: commitHash, Timestamp: timestamp}, nil
+}
+
+// getConfig returns the value of a git config key, or defaultValue if unset.
+func getConfig(key, defaultValue string) string {
+	output, err := exec.Command("git", "config", "--get", key).Output()
+	if err != nil {
+		return defaultValue
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// getConfigBool returns the value of a boolean git config key, or false if
+// it is unset or not a boolean.
+func getConfigBool(key string) bool {
+	output, err := exec.Command("git", "config", "--type=bool", "--get", key).Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
+
+func isShallowRepository() bool {
+	output, err := exec.Command("git", "rev-parse", "--is-shallow-repository").Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
+
+func isBareRepository() bool {
+	output, err := exec.Command("git", "rev-parse", "--is-bare-repository").Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
+
+const (
+	// largeBlobWarningSize is the size above which blobs are warned about
+	// when no -max-blob-size is given. It matches GitHub's warning threshold.
+	largeBlobWarningSize = 50 * 1024 * 1024
+	// lfsPointerMaxSize is the largest a Git LFS pointer file can be.
+	lfsPointerMaxSize = 1024
+	lfsPointerPrefix  = "version https://git-lfs.github.com/spec/"
+)
+
+// findSharedHistory describes each pair of remotes whose commits have a
+// common ancestor.
+func findSharedHistory(remoteCommits map[string]string) ([]string, error) {
+	remotes := make([]string, 0, len(remoteCommits))
+	for remote := range remoteCommits {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+
+	var overlaps []string
+	for i, a := range remotes {
+		for _, b := range remotes[i+1:] {
+			output, err := exec.Command("git", "merge-base", remoteCommits[a], remoteCommits[b]).Output()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+				// Unrelated histories, as expected
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to find merge base of %s and %s: %v", a, b, err)
+			}
+			overlaps = append(overlaps, fmt.Sprintf("%s and %s share history (merge base %s), so the monorepo holds their common files twice",
+				a, b, strings.TrimSpace(string(output))))
+		}
+	}
+	return overlaps, nil
+}
+
+// stitchDirs returns the directory each remote is stitched into: its own name
+// unless a -dir remote=dir override says otherwise, along with the sorted
+// -empty placeholder directories. Directories may be nested, but no directory
+// can be, or be inside, another one.
+func stitchDirs(remoteCommits map[string]string, overrides, empty []string) (map[string]string, []string, error) {
+	dirs := make(map[string]string)
+	for remote := range remoteCommits {
+		dirs[remote] = remote
+	}
+	for _, override := range overrides {
+		remote, dir, _ := strings.Cut(override, "=")
+		if _, ok := remoteCommits[remote]; !ok {
+			return nil, nil, fmt.Errorf("-dir %s: %s is not one of the remotes being stitched", override, remote)
+		}
+		cleaned, ok := cleanDir(dir)
+		if !ok {
+			return nil, nil, fmt.Errorf("-dir %s: the directory must be a relative path inside the monorepo", override)
+		}
+		dirs[remote] = cleaned
+	}
+
+	// Placeholders are checked for overlaps along with the remotes
+	owners := make(map[string]string)
+	for remote, dir := range dirs {
+		owners["remote "+remote] = dir
+	}
+	var emptyDirs []string
+	for _, dir := range empty {
+		cleaned, ok := cleanDir(dir)
+		if !ok {
+			return nil, nil, fmt.Errorf("-empty %s: the directory must be a relative path inside the monorepo", dir)
+		}
+		owners["placeholder "+cleaned] = cleaned
+		emptyDirs = append(emptyDirs, cleaned)
+	}
+	sort.Strings(emptyDirs)
+	if len(owners) < len(dirs)+len(emptyDirs) {
+		return nil, nil, fmt.Errorf("-empty %s given more than once", strings.Join(emptyDirs, ", "))
+	}
+
+	for outer, outerDir := range owners {
+		for inner, innerDir := range owners {
+			if outer != inner && (innerDir == outerDir || strings.HasPrefix(innerDir, outerDir+"/")) {
+				return nil, nil, fmt.Errorf("%s would be stitched into %s, inside %s's directory %s", inner, innerDir, outer, outerDir)
+			}
+		}
+	}
+	return dirs, emptyDirs, nil
+}
+
+// cleanDir normalizes a directory given on the command line, reporting
+// whether it is a relative path inside the monorepo. Backslashes are taken
+// as Windows-style separators, since tree paths always use slashes.
+func cleanDir(dir string) (string, bool) {
+	cleaned := path.Clean(strings.ReplaceAll(dir, "\\", "/"))
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") || path.IsAbs(cleaned) || hasDriveLetter(cleaned) {
+		return "", false
+	}
+	return cleaned, true
+}
+
+// placeholderTree returns a tree holding just an empty .gitkeep, for -empty
+// directories.
+func placeholderTree() (string, error) {
+	cmd := exec.Command("git", "hash-object", "-w", "--stdin")
+	cmd.Stdin = strings.NewReader("")
+	blob, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to create .gitkeep: %v", err)
+	}
+	entries := []string{fmt.Sprintf("100644 blob %s\t.gitkeep", strings.TrimSpace(string(blob)))}
+	if err := checkTreeEntries(entries); err != nil {
+		return "", err
+	}
+	cmd = exec.Command("git", "mktree")
+	cmd.Stdin = strings.NewReader(strings.Join(entries, "\n") + "\n")
+	tree, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to create placeholder tree: %v", err)
+	}
+	return strings.TrimSpace(string(tree)), nil
+}
+
+// hasDriveLetter reports whether p starts with a Windows drive, like C:.
+func hasDriveLetter(p string) bool {
+	return len(p) >= 2 && p[1] == ':' && ('a' <= p[0] && p[0] <= 'z' || 'A' <= p[0] && p[0] <= 'Z')
+}
+
+// mktreeNested creates a tree holding each of trees at its path, building the
+// intermediate trees that paths with slashes, like vendor/romeo, need.
+func mktreeNested(trees map[string]string) (string, error) {
+	var entries []string
+	children := make(map[string]map[string]string)
+	for path, hash := range trees {
+		dir, rest, nested := strings.Cut(path, "/")
+		if !nested {
+			entries = append(entries, fmt.Sprintf("040000 tree %s\t%s", hash, path))
+			continue
+		}
+		if children[dir] == nil {
+			children[dir] = make(map[string]string)
+		}
+		children[dir][rest] = hash
+	}
+	for dir, subtrees := range children {
+		hash, err := mktreeNested(subtrees)
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, fmt.Sprintf("040000 tree %s\t%s", hash, dir))
+	}
+	sort.Strings(entries)
+	if err := checkTreeEntries(entries); err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("git", "mktree")
+	cmd.Stdin = strings.NewReader(strings.Join(entries, "\n") + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// treeEntryPattern matches a line of git mktree input, which is ls-tree's
+// output format.
+var treeEntryPattern = regexp.MustCompile(`^[0-7]{6} (blob|tree|commit) [0-9a-f]{40}([0-9a-f]{24})?\t.+$`)
+
+// checkTreeEntries returns an error naming the first of entries that isn't
+// well-formed, which git mktree would otherwise reject without saying which.
+func checkTreeEntries(entries []string) error {
+	for _, entry := range entries {
+		if !treeEntryPattern.MatchString(entry) {
+			return fmt.Errorf("malformed tree entry %q: want \"<mode> <type> <hash>\\t<name>\"", entry)
+		}
+	}
+	return nil
+}
+
+// filterTree checks out treeHash into a temporary directory, runs command
+// there with the shell, and returns the hash of whatever tree is left. The
+// command sees the remote's name in $STITCH_REMOTE, and its output goes to
+// stderr to keep it apart from git-stitch's own.
+func filterTree(remote, treeHash, command string) (string, error) {
+	gitDir, err := exec.Command("git", "rev-parse", "--absolute-git-dir").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to find git directory: %v", err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "git-stitch-filter-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	workTree := filepath.Join(tmpDir, remote)
+	if err := os.MkdirAll(workTree, 0755); err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	env := append(os.Environ(),
+		"GIT_DIR="+strings.TrimSpace(string(gitDir)),
+		"GIT_WORK_TREE="+workTree,
+		"GIT_INDEX_FILE="+filepath.Join(tmpDir, "index"),
+	)
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = workTree
+		cmd.Env = env
+		output, err := cmd.Output()
+		return strings.TrimSpace(string(output)), err
+	}
+
+	if _, err := git("read-tree", treeHash); err != nil {
+		return "", fmt.Errorf("failed to read tree for %s: %v", remote, err)
+	}
+	if _, err := git("checkout-index", "--all"); err != nil {
+		return "", fmt.Errorf("failed to check out %s for -tree-filter: %v", remote, err)
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = workTree
+	cmd.Env = append(os.Environ(), "STITCH_REMOTE="+remote)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("-tree-filter failed for %s: %v", remote, err)
+	}
+
+	// The filter may have removed the directory entirely. Everything it
+	// leaves behind belongs in the tree, even files that the remote's
+	// .gitignore or the user's excludes match.
+	if err := os.MkdirAll(workTree, 0755); err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	if _, err := git("add", "--all", "--force", "."); err != nil {
+		return "", fmt.Errorf("failed to add filtered files for %s: %v", remote, err)
+	}
+	filtered, err := git("write-tree")
+	if err != nil {
+		return "", fmt.Errorf("failed to write filtered tree for %s: %v", remote, err)
+	}
+	verbosef("-tree-filter turned %s's tree %s into %s\n", remote, treeHash, filtered)
+	return filtered, nil
+}
+
+// blobStats counts the blobs in a tree, one per path.
+type blobStats struct {
+	Blobs int
+	Size  int64
+}
+
+// checkBlobs walks a remote's tree looking for blobs that would bloat the
+// monorepo. Blobs over maxBlobSize are an error; without a limit, very large
+// blobs are only warned about. Git LFS pointers are warned about as well,
+// since stitching copies the pointers but never the LFS content.
+func checkBlobs(remote, treeHash string, maxBlobSize int64) (blobStats, error) {
+	var stats blobStats
+	output, err := exec.Command("git", "ls-tree", "-r", "-l", treeHash).Output()
+	if err != nil {
+		return stats, fmt.Errorf("failed to list tree for %s: %v", remote, err)
+	}
+
+	var tooLarge []string
+	var smallBlobs []string
+	pathsByBlob := make(map[string][]string)
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		// Lines look like "<mode> <type> <hash> <size>\t<path>"
+		line := scanner.Text()
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[0])
+		if len(fields) != 4 || fields[1] != "blob" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			continue
+		}
+		path := remote + "/" + parts[1]
+		stats.Blobs++
+		stats.Size += size
+
+		switch {
+		case maxBlobSize > 0 && size > maxBlobSize:
+			tooLarge = append(tooLarge, fmt.Sprintf("%s (%d bytes)", path, size))
+		case maxBlobSize <= 0 && size > largeBlobWarningSize:
+			fmt.Fprintf(os.Stderr, "Warning: %s is %d bytes\n", path, size)
+		case size <= lfsPointerMaxSize:
+			if _, seen := pathsByBlob[fields[2]]; !seen {
+				smallBlobs = append(smallBlobs, fields[2])
+			}
+			pathsByBlob[fields[2]] = append(pathsByBlob[fields[2]], path)
+		}
+	}
+
+	lfsBlobs, err := findLFSPointers(smallBlobs)
+	if err != nil {
+		return stats, fmt.Errorf("failed to check %s for Git LFS pointers: %v", remote, err)
+	}
+	for _, blob := range lfsBlobs {
+		for _, path := range pathsByBlob[blob] {
+			fmt.Fprintf(os.Stderr, "Warning: %s is a Git LFS pointer; its content is not included in the monorepo\n", path)
+		}
+	}
+
+	if len(tooLarge) > 0 {
+		return stats, fmt.Errorf("blobs larger than -max-blob-size %d: %s", maxBlobSize, strings.Join(tooLarge, ", "))
+	}
+	return stats, nil
+}
+
+// findCaseCollisions returns the groups of paths in tree that differ only in
+// case. A collision is reported once, at the shallowest level it occurs:
+// when API and api collide, API/README.md and api/README.md aren't listed
+// again.
+func findCaseCollisions(treeHash string) ([][]string, error) {
+	output, err := exec.Command("git", "ls-tree", "-r", "-t", "-z", "--name-only", treeHash).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tree %s: %v", treeHash, err)
+	}
+
+	pathsByFolded := make(map[string][]string)
+	var folded []string
+	for _, p := range strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00") {
+		key := strings.ToLower(p)
+		if _, seen := pathsByFolded[key]; !seen {
+			folded = append(folded, key)
+		}
+		pathsByFolded[key] = append(pathsByFolded[key], p)
+	}
+
+	var collisions [][]string
+	for _, key := range folded {
+		// Entries of directories that themselves collide have different
+		// parents, and the directories are already reported
+		var parents []string
+		pathsByParent := make(map[string][]string)
+		for _, p := range pathsByFolded[key] {
+			parent := path.Dir(p)
+			if _, seen := pathsByParent[parent]; !seen {
+				parents = append(parents, parent)
+			}
+			pathsByParent[parent] = append(pathsByParent[parent], p)
+		}
+		for _, parent := range parents {
+			if len(pathsByParent[parent]) > 1 {
+				collisions = append(collisions, pathsByParent[parent])
+			}
+		}
+	}
+	return collisions, nil
+}
+
+// findLFSPointers returns the blobs whose content is a Git LFS pointer,
+// reading them all through a single git cat-file --batch process.
+func findLFSPointers(blobs []string) ([]string, error) {
+	if len(blobs) == 0 {
+		return nil, nil
+	}
+
+	cmd := exec.Command("git", "cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(strings.Join(blobs, "\n") + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var pointers []string
+	reader := bufio.NewReader(bytes.NewReader(output))
+	for range blobs {
+		// Each object is "<hash> <type> <size>\n<content>\n"
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected cat-file output: %q", header)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(reader, content); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(content, []byte(lfsPointerPrefix)) {
+			pointers = append(pointers, fields[0])
+		}
+	}
+	return pointers, nil
+}
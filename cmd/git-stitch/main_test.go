@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheckTreeEntries(t *testing.T) {
+	sha1 := strings.Repeat("a", 40)
+	sha256 := strings.Repeat("b", 64)
+	good := []string{
+		"040000 tree " + sha1 + "\trepo1",
+		"100644 blob " + sha1 + "\tREADME.md",
+		"120000 blob " + sha1 + "\tlink",
+		"160000 commit " + sha1 + "\tsubmodule",
+		"040000 tree " + sha256 + "\tsha256",
+	}
+	if err := checkTreeEntries(good); err != nil {
+		t.Errorf("Expected well-formed entries to pass, got: %v", err)
+	}
+
+	for _, bad := range []string{
+		"040000 tree " + sha1 + " repo1",         // space instead of tab
+		"40000 tree " + sha1 + "\trepo1",         // short mode
+		"040000 tag " + sha1 + "\trepo1",         // not a tree entry type
+		"040000 tree " + sha1[:39] + "\trepo1",   // short hash
+		"040000 tree " + sha256[:50] + "\trepo1", // neither SHA-1 nor SHA-256
+		"040000 tree " + sha1 + "\t",             // no name
+	} {
+		err := checkTreeEntries(append(good[:1:1], bad))
+		if err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+			continue
+		}
+		if !strings.Contains(err.Error(), "malformed tree entry "+strconv.Quote(bad)) {
+			t.Errorf("Expected the error to quote the bad entry %q, got: %v", bad, err)
+		}
+	}
+}
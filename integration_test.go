@@ -2,11 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // TestIntegration runs comprehensive end-to-end tests
@@ -39,6 +44,206 @@ func TestIntegration(t *testing.T) {
 	t.Run("SubdirectoryOperations", func(t *testing.T) {
 		testSubdirectoryOperations(t, testDir)
 	})
+
+	t.Run("AnnotatedTag", func(t *testing.T) {
+		testAnnotatedTag(t, testDir)
+	})
+
+	t.Run("StitchReportsBadRefs", func(t *testing.T) {
+		testStitchReportsBadRefs(t, testDir)
+	})
+
+	t.Run("StitchValidateOnly", func(t *testing.T) {
+		testStitchValidateOnly(t, testDir)
+	})
+
+	t.Run("BinaryFiles", func(t *testing.T) {
+		testBinaryFiles(t, testDir)
+	})
+
+	t.Run("ConfiguredAuthor", func(t *testing.T) {
+		testConfiguredAuthor(t, testDir)
+	})
+
+	t.Run("RipAuthorDateOrder", func(t *testing.T) {
+		testRipAuthorDateOrder(t, testDir)
+	})
+
+	t.Run("BareMonorepo", func(t *testing.T) {
+		testBareMonorepo(t, testDir)
+	})
+
+	t.Run("RipFirstParent", func(t *testing.T) {
+		testRipFirstParent(t, testDir)
+	})
+
+	t.Run("RipCommitPerFile", func(t *testing.T) {
+		testRipCommitPerFile(t, testDir)
+	})
+
+	t.Run("PreserveTrailers", func(t *testing.T) {
+		testPreserveTrailers(t, testDir)
+	})
+
+	t.Run("StitchBlobGuard", func(t *testing.T) {
+		testStitchBlobGuard(t, testDir)
+	})
+
+	t.Run("VerboseFlag", func(t *testing.T) {
+		testVerboseFlag(t, testDir)
+	})
+
+	t.Run("ExitCodes", func(t *testing.T) {
+		testExitCodes(t, testDir)
+	})
+
+	t.Run("RipOnUnrelatedBranch", func(t *testing.T) {
+		testRipOnUnrelatedBranch(t, testDir)
+	})
+
+	t.Run("TimezoneIndependence", func(t *testing.T) {
+		testTimezoneIndependence(t, testDir)
+	})
+
+	t.Run("NestedRemoteDir", func(t *testing.T) {
+		testNestedRemoteDir(t, testDir)
+	})
+
+	t.Run("RipTempIndexCleanup", func(t *testing.T) {
+		testRipTempIndexCleanup(t, testDir)
+	})
+
+	t.Run("IdenticalRemoteTrees", func(t *testing.T) {
+		testIdenticalRemoteTrees(t, testDir)
+	})
+
+	t.Run("CRLFCommitMessage", func(t *testing.T) {
+		testCRLFCommitMessage(t, testDir)
+	})
+
+	t.Run("PrimaryRemote", func(t *testing.T) {
+		testPrimaryRemote(t, testDir)
+	})
+
+	t.Run("RipPrefixFile", func(t *testing.T) {
+		testRipPrefixFile(t, testDir)
+	})
+
+	t.Run("MonorepoLocalCommits", func(t *testing.T) {
+		testMonorepoLocalCommits(t, testDir)
+	})
+
+	t.Run("ModeOnlyChange", func(t *testing.T) {
+		testModeOnlyChange(t, testDir)
+	})
+
+	t.Run("ShallowRemote", func(t *testing.T) {
+		testShallowRemote(t, testDir)
+	})
+
+	t.Run("SignedStitch", func(t *testing.T) {
+		testSignedStitch(t, testDir)
+	})
+
+	t.Run("StitchStats", func(t *testing.T) {
+		testStitchStats(t, testDir)
+	})
+
+	t.Run("CrossRemoteMove", func(t *testing.T) {
+		testCrossRemoteMove(t, testDir)
+	})
+
+	t.Run("StitchTreeFilter", func(t *testing.T) {
+		testStitchTreeFilter(t, testDir)
+	})
+
+	t.Run("NestedRemoteNames", func(t *testing.T) {
+		testNestedRemoteNames(t, testDir)
+	})
+
+	t.Run("RipNotes", func(t *testing.T) {
+		testRipNotes(t, testDir)
+	})
+
+	t.Run("NarrowFetchRefspec", func(t *testing.T) {
+		testNarrowFetchRefspec(t, testDir)
+	})
+
+	t.Run("RipCommitterDateNow", func(t *testing.T) {
+		testRipCommitterDateNow(t, testDir)
+	})
+
+	t.Run("StitchGitConfig", func(t *testing.T) {
+		testStitchGitConfig(t, testDir)
+	})
+
+	t.Run("BaseMarker", func(t *testing.T) {
+		testBaseMarker(t, testDir)
+	})
+
+	t.Run("RipTiming", func(t *testing.T) {
+		testRipTiming(t, testDir)
+	})
+
+	t.Run("RipExcludeCommit", func(t *testing.T) {
+		testRipExcludeCommit(t, testDir)
+	})
+
+	t.Run("StitchDirOverride", func(t *testing.T) {
+		testStitchDirOverride(t, testDir)
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		testVersion(t, testDir)
+	})
+
+	t.Run("CaseCollisions", func(t *testing.T) {
+		testCaseCollisions(t, testDir)
+	})
+
+	t.Run("RipFsck", func(t *testing.T) {
+		testRipFsck(t, testDir)
+	})
+
+	t.Run("StitchNoParents", func(t *testing.T) {
+		testStitchNoParents(t, testDir)
+	})
+
+	t.Run("StitchPinnedCommit", func(t *testing.T) {
+		testStitchPinnedCommit(t, testDir)
+	})
+
+	t.Run("RipPrefixTimestampFormat", func(t *testing.T) {
+		testRipPrefixTimestampFormat(t, testDir)
+	})
+
+	t.Run("Submodules", func(t *testing.T) {
+		testSubmodules(t, testDir)
+	})
+
+	t.Run("ParallelFetch", func(t *testing.T) {
+		testParallelFetch(t, testDir)
+	})
+
+	t.Run("StitchCheck", func(t *testing.T) {
+		testStitchCheck(t, testDir)
+	})
+
+	t.Run("StitchRefsFromStdin", func(t *testing.T) {
+		testStitchRefsFromStdin(t, testDir)
+	})
+
+	t.Run("SharedHistory", func(t *testing.T) {
+		testSharedHistory(t, testDir)
+	})
+
+	t.Run("RipLargeHistoryMemory", func(t *testing.T) {
+		testRipLargeHistoryMemory(t, testDir)
+	})
+
+	t.Run("StitchEmptyPlaceholders", func(t *testing.T) {
+		testStitchEmptyPlaceholders(t, testDir)
+	})
 }
 
 func buildTools(t *testing.T) {
@@ -224,14 +429,15 @@ func testREADMEFlow(t *testing.T, baseDir string) {
 
 	checkoutCommit(t, monoDir, "mono", commitHash)
 
-	// Add house metadata as per README
-	writeFile(t, filepath.Join(monoDir, "juliet", "house.txt"), "Caplet")
-	writeFile(t, filepath.Join(monoDir, "romeo", "house.txt"), "Romeo")
-	commitChanges(t, monoDir, "Adding house metadata.")
+	// Add house metadata as per README, with the same content and dates
+	writeFile(t, filepath.Join(monoDir, "juliet", "house.txt"), "Caplet\n")
+	writeFile(t, filepath.Join(monoDir, "romeo", "house.txt"), "Romeo\n")
+	runGitCmd(t, monoDir, "add", ".")
+	runGitCmdEnv(t, monoDir, []string{"GIT_AUTHOR_DATE=2024-01-01T00:00:00Z", "GIT_COMMITTER_DATE=2024-01-01T00:00:00Z"}, "commit", "-m", "Adding house metadata.")
 
 	// Fix typo as per README
-	writeFile(t, filepath.Join(monoDir, "juliet", "house.txt"), "Capulet")
-	commitChanges(t, monoDir, "Fixing typo")
+	writeFile(t, filepath.Join(monoDir, "juliet", "house.txt"), "Capulet\n")
+	runGitCmdEnv(t, monoDir, []string{"GIT_AUTHOR_DATE=2024-01-01T00:01:00Z", "GIT_COMMITTER_DATE=2024-01-01T00:01:00Z"}, "commit", "-a", "-m", "Fixing typo")
 
 	// Rip as per README
 	ripOutput := runGitRip(t, monoDir, "verona")
@@ -249,6 +455,25 @@ func testREADMEFlow(t *testing.T, baseDir string) {
 	checkoutBranch(t, monoDir, "verona-romeo")
 	verifyFileContent(t, filepath.Join(monoDir, "house.txt"), "Romeo")
 
+	// The hashes in the README's example must be the ones a real run gives
+	readme, err := os.ReadFile("README.md")
+	if err != nil {
+		t.Fatalf("Failed to read README.md: %v", err)
+	}
+	for _, expected := range []string{
+		"romeo/main is " + gitOutput(t, monoDir, "rev-parse", "romeo/main"),
+		"juliet/main is " + gitOutput(t, monoDir, "rev-parse", "juliet/main"),
+		"Stitched juliet & romeo into " + commitHash,
+		"git checkout -b mono " + commitHash,
+		"git reset " + commitHash,
+		"[mono " + gitOutput(t, monoDir, "rev-parse", "--short=7", "mono~1") + "] Adding house metadata.",
+		"[mono " + gitOutput(t, monoDir, "rev-parse", "--short=7", "mono") + "] Fixing typo",
+	} {
+		if !strings.Contains(string(readme), expected) {
+			t.Errorf("README.md example is out of date: expected %q", expected)
+		}
+	}
+
 	fmt.Printf("README Flow completed successfully with base commit: %s\n", commitHash)
 }
 
@@ -347,6 +572,18 @@ func runGitStitch(t *testing.T, dir string, args ...string) string {
 	return string(output)
 }
 
+func runGitStitchExpectError(t *testing.T, dir string, args ...string) string {
+	wd, _ := os.Getwd()
+	binaryPath := filepath.Join(wd, "git-stitch")
+	cmd := exec.Command(binaryPath, args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("Expected git-stitch to fail, output: %s", output)
+	}
+	return string(output)
+}
+
 func runGitRip(t *testing.T, dir string, args ...string) string {
 	// Get absolute path to git-rip binary
 	wd, _ := os.Getwd()
@@ -360,6 +597,31 @@ func runGitRip(t *testing.T, dir string, args ...string) string {
 	return string(output)
 }
 
+func runToolEnv(t *testing.T, dir, tool string, env []string, args ...string) string {
+	wd, _ := os.Getwd()
+	cmd := exec.Command(filepath.Join(wd, tool), args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s failed: %v, output: %s", tool, err, output)
+	}
+	return string(output)
+}
+
+func runToolExitCode(t *testing.T, dir, tool string, args ...string) (int, string) {
+	wd, _ := os.Getwd()
+	cmd := exec.Command(filepath.Join(wd, tool), args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), string(output)
+	} else if err != nil {
+		t.Fatalf("Failed to run %s: %v", tool, err)
+	}
+	return 0, string(output)
+}
+
 func runGitCmd(t *testing.T, dir string, args ...string) {
 	cmd := exec.Command("git", args...)
 	cmd.Dir = dir
@@ -368,6 +630,25 @@ func runGitCmd(t *testing.T, dir string, args ...string) {
 	}
 }
 
+func runGitCmdEnv(t *testing.T, dir string, env []string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("git %v failed: %v", args, err)
+	}
+}
+
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v failed: %v", args, err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
 func checkoutCommit(t *testing.T, dir, branch, commit string) {
 	runGitCmd(t, dir, "checkout", "-b", branch, commit)
 }
@@ -673,3 +954,2331 @@ func testSubdirectoryOperations(t *testing.T, baseDir string) {
 
 	t.Logf("Subdirectory operations test passed!")
 }
+
+func testAnnotatedTag(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "annotated-tag")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+
+	// Tag repo1 with a tagger date far in the future so that a timestamp read
+	// from the tag object instead of the commit would be obvious.
+	runGitCmdEnv(t, repo1Dir, []string{"GIT_COMMITTER_DATE=2099-01-01T00:00:00Z"}, "tag", "-a", "v1.0", "-m", "Release 1.0")
+
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+	runGitCmd(t, monoDir, "update-ref", "refs/remotes/repo1/v1.0", "refs/tags/v1.0")
+	if objType := gitOutput(t, monoDir, "cat-file", "-t", "repo1/v1.0"); objType != "tag" {
+		t.Fatalf("Expected repo1/v1.0 to be a tag object, got %s", objType)
+	}
+
+	output := runGitStitch(t, monoDir, "-no-fetch", "repo1/v1.0", "repo2/master")
+	commitHash := extractCommitHash(output)
+	if commitHash == "" {
+		t.Fatalf("Failed to extract commit hash from stitch output: %s", output)
+	}
+
+	// The first parent must be the tagged commit, not the tag object
+	taggedCommit := gitOutput(t, monoDir, "rev-parse", "repo1/v1.0^{commit}")
+	if parent := gitOutput(t, monoDir, "rev-parse", commitHash+"^1"); parent != taggedCommit {
+		t.Errorf("Expected first parent %s, got %s", taggedCommit, parent)
+	}
+
+	// The base commit's date must come from the commits, not the tag
+	expectedDate := gitOutput(t, monoDir, "show", "-s", "--format=%ct", taggedCommit)
+	if repo2Date := gitOutput(t, monoDir, "show", "-s", "--format=%ct", "repo2/master"); repo2Date > expectedDate {
+		expectedDate = repo2Date
+	}
+	if date := gitOutput(t, monoDir, "show", "-s", "--format=%ct", commitHash); date != expectedDate {
+		t.Errorf("Expected base commit date %s, got %s", expectedDate, date)
+	}
+}
+
+func testStitchReportsBadRefs(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "bad-refs")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	// The bad ref comes first to show that the good one is still resolved
+	output := runGitStitchExpectError(t, monoDir, "repo2/nonexistent", "repo1/master")
+	if !strings.Contains(output, "Error: repo2/nonexistent:") {
+		t.Errorf("Expected error naming repo2/nonexistent, got: %s", output)
+	}
+	if !strings.Contains(output, "repo1/master is ") {
+		t.Errorf("Expected repo1/master to still be resolved, got: %s", output)
+	}
+	if !strings.Contains(output, "failed to resolve 1 of 2 refs: repo2/nonexistent") {
+		t.Errorf("Expected failure summary, got: %s", output)
+	}
+	if strings.Contains(output, "Stitched") {
+		t.Errorf("Expected no commit to be created, got: %s", output)
+	}
+}
+
+func testStitchValidateOnly(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "validate")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	objectsBefore := gitOutput(t, monoDir, "count-objects", "-v")
+	output := runGitStitch(t, monoDir, "-no-fetch", "-validate", "repo1/master", "repo2/master")
+	objectsAfter := gitOutput(t, monoDir, "count-objects", "-v")
+
+	for _, ref := range []string{"repo1/master", "repo2/master"} {
+		expected := fmt.Sprintf("%s is %s", ref, gitOutput(t, monoDir, "rev-parse", ref))
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected validate output to contain %q, got: %s", expected, output)
+		}
+	}
+	if strings.Contains(output, "Stitched") {
+		t.Errorf("Expected no commit to be created, got: %s", output)
+	}
+	if objectsBefore != objectsAfter {
+		t.Errorf("Expected no new objects, before:\n%s\nafter:\n%s", objectsBefore, objectsAfter)
+	}
+
+	output = runGitStitchExpectError(t, monoDir, "-no-fetch", "-validate", "repo1/master", "repo2/nonexistent")
+	if !strings.Contains(output, "repo2/nonexistent") {
+		t.Errorf("Expected validate to name the bad ref, got: %s", output)
+	}
+}
+
+func testBinaryFiles(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "binary")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	// A PNG signature followed by bytes that don't survive text handling
+	original := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\xff\xfe\x00"
+	modified := original + "\x00\r\n\x80\x81\x00"
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"logo.png": original}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	commitHash := extractCommitHash(runGitStitch(t, monoDir, "repo1/master", "repo2/master"))
+	checkoutCommit(t, monoDir, "mono", commitHash)
+
+	writeFile(t, filepath.Join(monoDir, "repo1", "logo.png"), modified)
+	writeFile(t, filepath.Join(monoDir, "repo1", "new.bin"), "\x00\x01\x02\xff")
+	commitChanges(t, monoDir, "Update logo")
+
+	runGitRip(t, monoDir, "binary")
+
+	for path, expected := range map[string]string{"logo.png": modified, "new.bin": "\x00\x01\x02\xff"} {
+		cmd := exec.Command("git", "cat-file", "blob", "binary-repo1:"+path)
+		cmd.Dir = monoDir
+		content, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("Failed to read %s from split branch: %v", path, err)
+		}
+		if string(content) != expected {
+			t.Errorf("Binary content of %s mismatch. Expected: %q, Got: %q", path, expected, content)
+		}
+
+		// The split commit must reuse the monorepo's blob rather than
+		// hashing a copy of its content
+		if got, want := gitOutput(t, monoDir, "rev-parse", "binary-repo1:"+path), gitOutput(t, monoDir, "rev-parse", "mono:repo1/"+path); got != want {
+			t.Errorf("Blob for %s is %s on the split branch, expected the monorepo's %s", path, got, want)
+		}
+	}
+}
+
+func testConfiguredAuthor(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "author")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	defaultHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master"))
+	if identity := gitOutput(t, monoDir, "show", "-s", "--format=%an <%ae> %cn <%ce>", defaultHash); identity != "git-stitch <git-stitch@localhost> git-stitch <git-stitch@localhost>" {
+		t.Errorf("Unexpected default identity: %s", identity)
+	}
+
+	runGitCmd(t, monoDir, "config", "stitch.author-name", "Monorepo Bot")
+	runGitCmd(t, monoDir, "config", "stitch.author-email", "bot@example.com")
+	commitHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master"))
+	if identity := gitOutput(t, monoDir, "show", "-s", "--format=%an <%ae> %cn <%ce>", commitHash); identity != "Monorepo Bot <bot@example.com> Monorepo Bot <bot@example.com>" {
+		t.Errorf("Expected configured identity, got: %s", identity)
+	}
+}
+
+func testRipAuthorDateOrder(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "author-date-order")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	commitHash := extractCommitHash(runGitStitch(t, monoDir, "repo1/master", "repo2/master"))
+	checkoutCommit(t, monoDir, "mono", commitHash)
+	runGitCmd(t, monoDir, "branch", "side")
+
+	// "Later work" is committed first but authored after "Earlier work",
+	// which lives on a side branch and is merged afterwards.
+	writeFile(t, filepath.Join(monoDir, "repo1", "later.txt"), "later")
+	runGitCmd(t, monoDir, "add", ".")
+	runGitCmdEnv(t, monoDir, []string{"GIT_AUTHOR_DATE=2091-03-01T00:00:00Z", "GIT_COMMITTER_DATE=2091-03-01T00:00:00Z"}, "commit", "-m", "Later work")
+
+	checkoutBranch(t, monoDir, "side")
+	writeFile(t, filepath.Join(monoDir, "repo1", "earlier.txt"), "earlier")
+	runGitCmd(t, monoDir, "add", ".")
+	runGitCmdEnv(t, monoDir, []string{"GIT_AUTHOR_DATE=2091-01-01T00:00:00Z", "GIT_COMMITTER_DATE=2091-03-02T00:00:00Z"}, "commit", "-m", "Earlier work")
+
+	checkoutBranch(t, monoDir, "mono")
+	runGitCmdEnv(t, monoDir, []string{"GIT_AUTHOR_DATE=2091-03-03T00:00:00Z", "GIT_COMMITTER_DATE=2091-03-03T00:00:00Z"}, "merge", "--no-ff", "-m", "Merge side", "side")
+
+	runGitRip(t, monoDir, "default")
+	if subjects := gitOutput(t, monoDir, "log", "--format=%s", "-2", "default-repo1"); subjects != "Earlier work\nLater work" {
+		t.Errorf("Expected default order to follow commit order, got:\n%s", subjects)
+	}
+
+	runGitRip(t, monoDir, "-order", "author-date", "authordate")
+	if subjects := gitOutput(t, monoDir, "log", "--format=%s", "-2", "authordate-repo1"); subjects != "Later work\nEarlier work" {
+		t.Errorf("Expected author-date order to replay earlier work first, got:\n%s", subjects)
+	}
+	checkoutBranch(t, monoDir, "authordate-repo1")
+	verifyFileContent(t, filepath.Join(monoDir, "earlier.txt"), "earlier")
+	verifyFileContent(t, filepath.Join(monoDir, "later.txt"), "later")
+}
+
+func testBareMonorepo(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "bare")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	bareDir := filepath.Join(testDir, "mono.git")
+	workDir := filepath.Join(testDir, "work")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1", "src/app.go": "package app"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+
+	os.MkdirAll(bareDir, 0755)
+	runGitCmd(t, bareDir, "init", "--bare")
+	runGitCmd(t, bareDir, "remote", "add", "repo1", repo1Dir)
+	runGitCmd(t, bareDir, "remote", "add", "repo2", repo2Dir)
+
+	stitchOutput := runGitStitch(t, bareDir, "repo1/master", "repo2/master")
+	commitHash := extractCommitHash(stitchOutput)
+	if !strings.Contains(stitchOutput, "git update-ref refs/heads/mono "+commitHash) {
+		t.Errorf("Expected an update-ref hint for a bare repository, got: %s", stitchOutput)
+	}
+	runGitCmd(t, bareDir, "update-ref", "refs/heads/mono", commitHash)
+	runGitCmd(t, bareDir, "symbolic-ref", "HEAD", "refs/heads/mono")
+
+	// Make a monorepo commit elsewhere and push it into the bare repository
+	runGitCmd(t, testDir, "clone", bareDir, workDir)
+	runGitCmd(t, workDir, "config", "user.name", "Test User")
+	runGitCmd(t, workDir, "config", "user.email", "test@example.com")
+	writeFile(t, filepath.Join(workDir, "repo1", "src", "app.go"), "package app // changed")
+	commitChanges(t, workDir, "Change app")
+	runGitCmd(t, workDir, "push", "origin", "mono")
+
+	ripOutput := runGitRip(t, bareDir, "bare")
+	if !strings.Contains(ripOutput, "bare-repo1") {
+		t.Errorf("Expected rip output to contain 'bare-repo1', got: %s", ripOutput)
+	}
+	if content := gitOutput(t, bareDir, "cat-file", "blob", "bare-repo1:src/app.go"); content != "package app // changed" {
+		t.Errorf("Unexpected content on split branch: %s", content)
+	}
+	if parent := gitOutput(t, bareDir, "rev-parse", "bare-repo1^"); parent != gitOutput(t, bareDir, "rev-parse", "repo1/master") {
+		t.Errorf("Expected split branch to build on repo1/master, got parent %s", parent)
+	}
+}
+
+func testRipFirstParent(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "first-parent")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	commitHash := extractCommitHash(runGitStitch(t, monoDir, "repo1/master", "repo2/master"))
+	checkoutCommit(t, monoDir, "mono", commitHash)
+	runGitCmd(t, monoDir, "branch", "feature")
+
+	writeFile(t, filepath.Join(monoDir, "repo1", "mainline.txt"), "mainline")
+	commitChanges(t, monoDir, "Mainline change")
+
+	checkoutBranch(t, monoDir, "feature")
+	writeFile(t, filepath.Join(monoDir, "repo1", "feature1.txt"), "feature 1")
+	commitChanges(t, monoDir, "Feature part 1")
+	writeFile(t, filepath.Join(monoDir, "repo1", "feature2.txt"), "feature 2")
+	writeFile(t, filepath.Join(monoDir, "repo2", "feature.txt"), "feature")
+	commitChanges(t, monoDir, "Feature part 2")
+
+	checkoutBranch(t, monoDir, "mono")
+	runGitCmd(t, monoDir, "merge", "--no-ff", "-m", "Merge feature", "feature")
+
+	runGitRip(t, monoDir, "all")
+	if count := gitOutput(t, monoDir, "rev-list", "--count", "all-repo1"); count != "4" {
+		t.Errorf("Expected 4 commits on all-repo1, got %s", count)
+	}
+
+	runGitRip(t, monoDir, "-first-parent", "mainline")
+	if count := gitOutput(t, monoDir, "rev-list", "--count", "mainline-repo1"); count != "3" {
+		t.Errorf("Expected 3 commits on mainline-repo1, got %s", count)
+	}
+	if subject := gitOutput(t, monoDir, "log", "-1", "--format=%s", "mainline-repo1"); subject != "Merge feature" {
+		t.Errorf("Expected the merge to carry the feature, got %q", subject)
+	}
+	if subject := gitOutput(t, monoDir, "log", "-1", "--format=%s", "mainline-repo2"); subject != "Merge feature" {
+		t.Errorf("Expected the merge to carry the feature to repo2, got %q", subject)
+	}
+	for _, branch := range []string{"all-repo1", "mainline-repo1"} {
+		if tree, expected := gitOutput(t, monoDir, "rev-parse", branch+"^{tree}"), gitOutput(t, monoDir, "rev-parse", "HEAD:repo1"); tree != expected {
+			t.Errorf("Expected %s to match the monorepo's repo1 tree %s, got %s", branch, expected, tree)
+		}
+	}
+}
+
+func testRipCommitPerFile(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "commit-per-file")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	commitHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master"))
+	checkoutCommit(t, monoDir, "mono", commitHash)
+
+	writeFile(t, filepath.Join(monoDir, "repo1", "a.txt"), "a")
+	writeFile(t, filepath.Join(monoDir, "repo1", "b.txt"), "b")
+	writeFile(t, filepath.Join(monoDir, "repo2", "c.txt"), "c")
+	commitChanges(t, monoDir, "Add files")
+
+	// Without -first-parent, each changed file gets its own commit
+	runGitRip(t, monoDir, "split")
+	if count := gitOutput(t, monoDir, "rev-list", "--count", "repo1/master..split-repo1"); count != "2" {
+		t.Errorf("Expected a commit per file on split-repo1, got %s", count)
+	}
+	if count := gitOutput(t, monoDir, "rev-list", "--count", "repo2/master..split-repo2"); count != "1" {
+		t.Errorf("Expected 1 commit on split-repo2, got %s", count)
+	}
+	for _, rev := range []string{"split-repo1", "split-repo1~1"} {
+		if subject := gitOutput(t, monoDir, "log", "-1", "--format=%s", rev); subject != "Add files" {
+			t.Errorf("Expected %s to keep the original message, got %q", rev, subject)
+		}
+		if files := gitOutput(t, monoDir, "diff-tree", "--no-commit-id", "--name-only", "-r", rev); strings.Contains(files, "\n") {
+			t.Errorf("Expected %s to change a single file, got:\n%s", rev, files)
+		}
+	}
+	if tree, expected := gitOutput(t, monoDir, "rev-parse", "split-repo1^{tree}"), gitOutput(t, monoDir, "rev-parse", "HEAD:repo1"); tree != expected {
+		t.Errorf("Expected split-repo1 to match the monorepo's repo1 tree %s, got %s", expected, tree)
+	}
+}
+
+func testPreserveTrailers(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "trailers")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	commitHash := extractCommitHash(runGitStitch(t, monoDir, "repo1/master", "repo2/master"))
+	checkoutCommit(t, monoDir, "mono", commitHash)
+
+	message := "  Indented subject\n\n    indented body line\n\n" +
+		"Signed-off-by: Alice <alice@example.com>\n" +
+		"Signed-off-by: Bob <bob@example.com>\n" +
+		"Change-Id: I0123456789abcdef0123456789abcdef01234567\n"
+	messageFile := filepath.Join(testDir, "message.txt")
+	writeFile(t, messageFile, message)
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	runGitCmd(t, monoDir, "add", ".")
+	runGitCmd(t, monoDir, "commit", "--cleanup=verbatim", "-F", messageFile)
+
+	runGitRip(t, monoDir, "trailers")
+
+	cmd := exec.Command("git", "log", "-1", "--format=%B", "trailers-repo1")
+	cmd.Dir = monoDir
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git log failed: %v", err)
+	}
+	// --format=%B is followed by a newline separating it from the next commit
+	if body := strings.TrimSuffix(string(output), "\n"); body != message {
+		t.Errorf("Commit message mismatch.\nExpected: %q\nGot:      %q", message, body)
+	}
+}
+
+func testStitchBlobGuard(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "blob-guard")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	lfsPointer := "version https://git-lfs.github.com/spec/v1\n" +
+		"oid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393\n" +
+		"size 12345\n"
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{
+			"README.md":      "# Repo 1",
+			"assets/big.bin": strings.Repeat("x", 2000),
+		}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2", "video.mp4": lfsPointer}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	output := runGitStitchExpectError(t, monoDir, "-no-fetch", "-max-blob-size", "1000", "repo1/master", "repo2/master")
+	if !strings.Contains(output, "repo1/assets/big.bin (2000 bytes)") {
+		t.Errorf("Expected the oversized blob to be reported, got: %s", output)
+	}
+	if strings.Contains(output, "Stitched") {
+		t.Errorf("Expected no commit to be created, got: %s", output)
+	}
+
+	output = runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")
+	if !strings.Contains(output, "Warning: repo2/video.mp4 is a Git LFS pointer") {
+		t.Errorf("Expected a Git LFS pointer warning, got: %s", output)
+	}
+	if strings.Contains(output, "README.md is a Git LFS pointer") {
+		t.Errorf("Expected only LFS pointers to be reported, got: %s", output)
+	}
+}
+
+func testVerboseFlag(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "verbose")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	output := runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")
+	if strings.Contains(output, "Created tree") {
+		t.Errorf("Expected no diagnostics by default, got: %s", output)
+	}
+	output = runGitStitch(t, monoDir, "-v", "-no-fetch", "repo1/master", "repo2/master")
+	if !strings.Contains(output, "Remote repo1 has tree") || !strings.Contains(output, "Created tree") {
+		t.Errorf("Expected diagnostics with -v, got: %s", output)
+	}
+	output = runToolEnv(t, monoDir, "git-stitch", []string{"GIT_STITCH_VERBOSE=1"}, "-no-fetch", "repo1/master", "repo2/master")
+	if !strings.Contains(output, "Created tree") {
+		t.Errorf("Expected diagnostics with GIT_STITCH_VERBOSE, got: %s", output)
+	}
+	output = runToolEnv(t, monoDir, "git-stitch", []string{"GIT_STITCH_VERBOSE=1"}, "-v=false", "-no-fetch", "repo1/master", "repo2/master")
+	if strings.Contains(output, "Created tree") {
+		t.Errorf("Expected -v=false to override GIT_STITCH_VERBOSE, got: %s", output)
+	}
+
+	checkoutCommit(t, monoDir, "mono", extractCommitHash(output))
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo1")
+
+	output = runGitRip(t, monoDir, "quiet")
+	if strings.Contains(output, "Found base commit") {
+		t.Errorf("Expected no diagnostics by default, got: %s", output)
+	}
+	output = runGitRip(t, monoDir, "-verbose", "loud")
+	if !strings.Contains(output, "Found base commit") || !strings.Contains(output, "Processing commit") {
+		t.Errorf("Expected diagnostics with -verbose, got: %s", output)
+	}
+}
+
+func testExitCodes(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "exit-codes")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	plainDir := filepath.Join(testDir, "plain")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, plainDir, "plain", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Not a monorepo"}},
+	})
+	runGitCmd(t, plainDir, "remote", "add", "repo1", repo1Dir)
+	runGitCmd(t, plainDir, "fetch", "repo1")
+
+	for _, tc := range []struct {
+		name     string
+		tool     string
+		args     []string
+		expected int
+	}{
+		{"stitch without arguments", "git-stitch", nil, 2},
+		{"stitch without refs", "git-stitch", []string{"-no-fetch"}, 2},
+		{"stitch with malformed ref", "git-stitch", []string{"-no-fetch", "master"}, 2},
+		{"stitch with unknown remote", "git-stitch", []string{"-no-fetch", "nope/master"}, 3},
+		{"stitch with unknown branch", "git-stitch", []string{"-no-fetch", "repo1/nope"}, 3},
+		{"rip with unknown order", "git-rip", []string{"-order", "sideways"}, 2},
+		{"rip with two prefixes", "git-rip", []string{"prefix", "typo"}, 2},
+		{"rip outside a monorepo", "git-rip", []string{"plain"}, 3},
+	} {
+		code, output := runToolExitCode(t, plainDir, tc.tool, tc.args...)
+		if code != tc.expected {
+			t.Errorf("%s: expected exit code %d, got %d, output: %s", tc.name, tc.expected, code, output)
+		}
+	}
+}
+
+func testRipOnUnrelatedBranch(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "unrelated-branch")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	commitHash := extractCommitHash(runGitStitch(t, monoDir, "repo1/master", "repo2/master"))
+	checkoutCommit(t, monoDir, "mono", commitHash)
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo1")
+
+	// Switch to a branch that doesn't contain the base commit
+	runGitCmd(t, monoDir, "checkout", "repo1/master")
+
+	code, output := runToolExitCode(t, monoDir, "git-rip", "unrelated")
+	if code != 3 {
+		t.Errorf("Expected exit code 3, got %d", code)
+	}
+	if !strings.Contains(output, "are you on the right branch?") {
+		t.Errorf("Expected a hint about the current branch, got: %s", output)
+	}
+}
+
+func testTimezoneIndependence(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "timezones")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	utcHash := extractCommitHash(runToolEnv(t, monoDir, "git-stitch", []string{"TZ=UTC"}, "-no-fetch", "repo1/master", "repo2/master"))
+	laHash := extractCommitHash(runToolEnv(t, monoDir, "git-stitch", []string{"TZ=America/Los_Angeles"}, "-no-fetch", "repo1/master", "repo2/master"))
+	if utcHash != laHash {
+		t.Errorf("git-stitch depends on TZ: got %s under UTC and %s under America/Los_Angeles", utcHash, laHash)
+	}
+
+	checkoutCommit(t, monoDir, "mono", utcHash)
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	runGitCmd(t, monoDir, "add", ".")
+	runGitCmdEnv(t, monoDir, []string{"GIT_AUTHOR_DATE=1700000000 +0530", "GIT_COMMITTER_DATE=1700000100 -0300"}, "commit", "-m", "Change repo1")
+
+	runToolEnv(t, monoDir, "git-rip", []string{"TZ=UTC"}, "utc")
+	runToolEnv(t, monoDir, "git-rip", []string{"TZ=America/Los_Angeles"}, "la")
+	if utc, la := gitOutput(t, monoDir, "rev-parse", "utc-repo1"), gitOutput(t, monoDir, "rev-parse", "la-repo1"); utc != la {
+		t.Errorf("git-rip depends on TZ: got %s under UTC and %s under America/Los_Angeles", utc, la)
+	}
+	if dates := gitOutput(t, monoDir, "log", "-1", "--date=raw", "--format=%ad %cd", "utc-repo1"); dates != "1700000000 +0530 1700000100 -0300" {
+		t.Errorf("Expected original dates and offsets to be kept, got %s", dates)
+	}
+}
+
+func testNestedRemoteDir(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "nested-dir")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"lib.go": "package lib"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	// Build a base merge commit with repo1 stitched into vendor/libs.
+	indexEnv := []string{"GIT_INDEX_FILE=" + filepath.Join(testDir, "index")}
+	runGitCmdEnv(t, monoDir, indexEnv, "read-tree", "--prefix=vendor/libs/", "repo1/master")
+	runGitCmdEnv(t, monoDir, indexEnv, "read-tree", "--prefix=repo2/", "repo2/master")
+	cmd := exec.Command("git", "write-tree")
+	cmd.Dir = monoDir
+	cmd.Env = append(os.Environ(), indexEnv...)
+	tree, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git write-tree failed: %v", err)
+	}
+	base := gitOutput(t, monoDir, "commit-tree", "-p", "repo1/master", "-p", "repo2/master", "-m", "git-stitch merge", strings.TrimSpace(string(tree)))
+
+	checkoutCommit(t, monoDir, "mono", base)
+	writeFile(t, filepath.Join(monoDir, "vendor", "libs", "lib.go"), "package lib // changed")
+	writeFile(t, filepath.Join(monoDir, "repo2", "README.md"), "# Repo 2 changed")
+	commitChanges(t, monoDir, "Change both remotes")
+
+	runGitRip(t, monoDir, "nested")
+	verifyBranchExists(t, monoDir, "nested-vendor/libs")
+	verifyBranchExists(t, monoDir, "nested-repo2")
+
+	if content := gitOutput(t, monoDir, "show", "nested-vendor/libs:lib.go"); content != "package lib // changed" {
+		t.Errorf("Expected nested change to be attributed to vendor/libs, got %q", content)
+	}
+	if parent := gitOutput(t, monoDir, "rev-parse", "nested-vendor/libs^"); parent != gitOutput(t, monoDir, "rev-parse", "repo1/master") {
+		t.Errorf("Expected vendor/libs branch to build on repo1/master, got parent %s", parent)
+	}
+}
+
+func testRipTempIndexCleanup(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "temp-index")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+	tmpDir := filepath.Join(testDir, "tmp")
+	os.MkdirAll(tmpDir, 0755)
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	checkoutCommit(t, monoDir, "mono", extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")))
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo1")
+
+	wd, _ := os.Getwd()
+	ripPath := filepath.Join(wd, "git-rip")
+	tmpEnv := []string{"TMPDIR=" + tmpDir}
+
+	runToolEnv(t, monoDir, "git-rip", tmpEnv, "clean")
+	if leftover, _ := filepath.Glob(filepath.Join(tmpDir, "git-rip-index-*")); len(leftover) > 0 {
+		t.Errorf("Expected temporary indexes to be removed after rip, found %v", leftover)
+	}
+
+	// Hold write-tree in a git wrapper so git-rip can be interrupted while
+	// its temporary index exists. The wrapper reports that it has started
+	// through one FIFO and waits on another until it is released.
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatalf("git not found: %v", err)
+	}
+	binDir := filepath.Join(testDir, "bin")
+	os.MkdirAll(binDir, 0755)
+	started := filepath.Join(testDir, "write-tree-started")
+	release := filepath.Join(testDir, "write-tree-release")
+	for _, fifo := range []string{started, release} {
+		if err := syscall.Mkfifo(fifo, 0600); err != nil {
+			t.Fatalf("Failed to create FIFO %s: %v", fifo, err)
+		}
+	}
+	wrapper := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = write-tree ]; then echo > %q; cat %q > /dev/null; fi\nexec %q \"$@\"\n", started, release, realGit)
+	if err := os.WriteFile(filepath.Join(binDir, "git"), []byte(wrapper), 0755); err != nil {
+		t.Fatalf("Failed to write git wrapper: %v", err)
+	}
+
+	cmd := exec.Command(ripPath, "interrupted")
+	cmd.Dir = monoDir
+	cmd.Env = append(os.Environ(), append(tmpEnv, "PATH="+binDir+string(os.PathListSeparator)+os.Getenv("PATH"))...)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start git-rip: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		// Opening a FIFO read-write never blocks, and closing it again
+		// unblocks whichever end is still waiting
+		for _, fifo := range []string{started, release} {
+			if f, err := os.OpenFile(fifo, os.O_RDWR, 0); err == nil {
+				f.Close()
+			}
+		}
+	})
+
+	reached := make(chan error, 1)
+	go func() {
+		f, err := os.Open(started)
+		if err == nil {
+			_, err = io.ReadAll(f)
+			f.Close()
+		}
+		reached <- err
+	}()
+	select {
+	case err := <-reached:
+		if err != nil {
+			t.Fatalf("Failed to wait for write-tree: %v", err)
+		}
+	case err := <-exited:
+		t.Fatalf("git-rip exited before reaching write-tree: %v", err)
+	}
+	if inFlight, _ := filepath.Glob(filepath.Join(tmpDir, "git-rip-index-*")); len(inFlight) == 0 {
+		t.Errorf("Expected a temporary index while git-rip is running")
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to send SIGTERM to git-rip: %v", err)
+	}
+	err = <-exited
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Errorf("Expected git-rip to exit with status %d after SIGTERM, got: %v", 128+int(syscall.SIGTERM), err)
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(tmpDir, "git-rip-index-*")); len(leftover) > 0 {
+		t.Errorf("Expected temporary indexes to be removed after SIGTERM, found %v", leftover)
+	}
+}
+
+func testIdenticalRemoteTrees(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "identical-trees")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	// Same contents, different commits
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Start repo1", Files: map[string]string{"README.md": "# Shared"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Start repo2", Files: map[string]string{"README.md": "# Shared"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master"))
+	trailers := gitOutput(t, monoDir, "show", "-s", "--format=%(trailers:key=Stitch-Parent)", stitchHash)
+	for _, remote := range []string{"repo1", "repo2"} {
+		expected := fmt.Sprintf("Stitch-Parent: %s %s", remote, gitOutput(t, monoDir, "rev-parse", remote+"/master"))
+		if !strings.Contains(trailers, expected) {
+			t.Errorf("Expected base commit to record %q, got %q", expected, trailers)
+		}
+	}
+
+	checkoutCommit(t, monoDir, "mono", stitchHash)
+	writeFile(t, filepath.Join(monoDir, "repo2", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo2")
+
+	runGitRip(t, monoDir, "same")
+	if parent, expected := gitOutput(t, monoDir, "rev-parse", "same-repo2^"), gitOutput(t, monoDir, "rev-parse", "repo2/master"); parent != expected {
+		t.Errorf("Expected same-repo2 to build on repo2/master %s, got %s", expected, parent)
+	}
+}
+
+func testCRLFCommitMessage(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "crlf-message")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	checkoutCommit(t, monoDir, "mono", extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")))
+
+	messages := map[string]string{
+		"crlf":  "Windows subject\r\n\r\nBody line\r\nSigned-off-by: Test User <test@example.com>\r\n",
+		"mixed": "Mixed subject\r\n\nLF line\nCRLF line\r\n",
+	}
+	for _, name := range []string{"crlf", "mixed"} {
+		msgFile := filepath.Join(testDir, name+".msg")
+		writeFile(t, msgFile, messages[name])
+		writeFile(t, filepath.Join(monoDir, "repo1", name+".txt"), name)
+		runGitCmd(t, monoDir, "add", ".")
+		runGitCmd(t, monoDir, "commit", "--cleanup=verbatim", "-F", msgFile)
+	}
+
+	runGitRip(t, monoDir, "crlf")
+	for i, name := range []string{"mixed", "crlf"} {
+		cmd := exec.Command("git", "show", "-s", "--format=%B", fmt.Sprintf("crlf-repo1~%d", i))
+		cmd.Dir = monoDir
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git show failed: %v", err)
+		}
+		// --format adds a newline after %B
+		if got := strings.TrimSuffix(string(output), "\n"); got != messages[name] {
+			t.Errorf("Expected %s message %q to be preserved exactly, got %q", name, messages[name], got)
+		}
+	}
+}
+
+func testPrimaryRemote(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "primary")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	repo3Dir := filepath.Join(testDir, "repo3")
+	monoDir := filepath.Join(testDir, "mono")
+
+	for i, dir := range []string{repo1Dir, repo2Dir, repo3Dir} {
+		name := fmt.Sprintf("repo%d", i+1)
+		createTestRepo(t, dir, name, []TestCommit{
+			{Message: "Initial commit", Files: map[string]string{"README.md": "# " + name}},
+		})
+	}
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+		"repo3": repo3Dir,
+	})
+
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "-primary", "repo2", "repo1/master", "repo2/master", "repo3/master"))
+	expected := strings.Join([]string{
+		gitOutput(t, monoDir, "rev-parse", "repo2/master"),
+		gitOutput(t, monoDir, "rev-parse", "repo1/master"),
+		gitOutput(t, monoDir, "rev-parse", "repo3/master"),
+	}, " ")
+	if parents := gitOutput(t, monoDir, "show", "-s", "--format=%P", stitchHash); parents != expected {
+		t.Errorf("Expected parents %s with repo2 first, got %s", expected, parents)
+	}
+
+	code, output := runToolExitCode(t, monoDir, "git-stitch", "-no-fetch", "-primary", "repo4", "repo1/master", "repo2/master")
+	if code != 2 || !strings.Contains(output, "-primary repo4") {
+		t.Errorf("Expected exit code 2 for an unknown primary remote, got %d: %s", code, output)
+	}
+}
+
+func testRipPrefixFile(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "prefix-file")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	checkoutCommit(t, monoDir, "mono", extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")))
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo1")
+
+	prefixFile := filepath.Join(testDir, "prefix")
+	writeFile(t, prefixFile, "  pr/123\n")
+	runGitRip(t, monoDir, "-prefix-file", prefixFile)
+	verifyBranchExists(t, monoDir, "pr/123-repo1")
+
+	if code, output := runToolExitCode(t, monoDir, "git-rip", "-prefix-file", prefixFile, "other"); code != 2 {
+		t.Errorf("Expected exit code 2 for both a prefix and -prefix-file, got %d: %s", code, output)
+	}
+
+	writeFile(t, prefixFile, "bad..prefix\n")
+	code, output := runToolExitCode(t, monoDir, "git-rip", "-prefix-file", prefixFile)
+	if code != 2 || !strings.Contains(output, "not a valid branch name") {
+		t.Errorf("Expected exit code 2 for an invalid prefix, got %d: %s", code, output)
+	}
+}
+
+func testMonorepoLocalCommits(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "monorepo-local")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	checkoutCommit(t, monoDir, "mono", extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")))
+
+	writeFile(t, filepath.Join(monoDir, "repo1", "ci.yml"), "local only")
+	writeFile(t, filepath.Join(monoDir, "repo2", "ci.yml"), "local only")
+	commitChanges(t, monoDir, "Tweak CI for the monorepo\n\nMonorepo-Local: true")
+	localCommit := gitOutput(t, monoDir, "rev-parse", "HEAD")
+
+	// Only a value of exactly "true" makes a commit local
+	writeFile(t, filepath.Join(monoDir, "repo1", "notes.txt"), "notes")
+	commitChanges(t, monoDir, "Add notes\n\nMonorepo-Local: not true")
+
+	writeFile(t, filepath.Join(monoDir, "repo1", "feature.txt"), "feature")
+	commitChanges(t, monoDir, "Add feature")
+
+	output := runGitRip(t, monoDir, "local")
+	if !strings.Contains(output, "Skipping monorepo-local commit "+localCommit) {
+		t.Errorf("Expected the skipped commit to be reported, got: %s", output)
+	}
+
+	if log := gitOutput(t, monoDir, "log", "--format=%s", "repo1/master..local-repo1"); log != "Add feature\nAdd notes" {
+		t.Errorf("Expected the feature and notes commits on local-repo1, got %q", log)
+	}
+	if files := gitOutput(t, monoDir, "ls-tree", "--name-only", "local-repo1"); strings.Contains(files, "ci.yml") {
+		t.Errorf("Expected ci.yml to stay out of local-repo1, got files: %s", files)
+	}
+	if head, original := gitOutput(t, monoDir, "rev-parse", "local-repo2"), gitOutput(t, monoDir, "rev-parse", "repo2/master"); head != original {
+		t.Errorf("Expected local-repo2 to stay at repo2/master %s, since its only change was monorepo-local, got %s", original, head)
+	}
+}
+
+func testModeOnlyChange(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "mode-only")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"build.sh": "#!/bin/sh\necho build\n"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	checkoutCommit(t, monoDir, "mono", extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")))
+
+	// update-index --chmod works the same whatever core.fileMode says
+	runGitCmd(t, monoDir, "update-index", "--chmod=+x", "repo1/build.sh")
+	runGitCmd(t, monoDir, "commit", "-m", "Make build.sh executable")
+	runGitCmd(t, monoDir, "update-index", "--chmod=-x", "repo1/build.sh")
+	runGitCmd(t, monoDir, "commit", "-m", "Make build.sh plain again")
+
+	runGitRip(t, monoDir, "mode")
+	if log := gitOutput(t, monoDir, "log", "--format=%s", "repo1/master..mode-repo1"); log != "Make build.sh plain again\nMake build.sh executable" {
+		t.Errorf("Expected both mode changes to be ripped, got %q", log)
+	}
+	for ref, expected := range map[string]string{"mode-repo1~1": "100755", "mode-repo1": "100644"} {
+		entry := gitOutput(t, monoDir, "ls-tree", ref, "build.sh")
+		if !strings.HasPrefix(entry, expected+" ") {
+			t.Errorf("Expected build.sh to have mode %s at %s, got %q", expected, ref, entry)
+		}
+	}
+	if blob, original := gitOutput(t, monoDir, "rev-parse", "mode-repo1~1:build.sh"), gitOutput(t, monoDir, "rev-parse", "repo1/master:build.sh"); blob != original {
+		t.Errorf("Expected build.sh contents to be unchanged, got blob %s instead of %s", blob, original)
+	}
+}
+
+func testShallowRemote(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "shallow")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+		{Message: "Second commit", Files: map[string]string{"more.txt": "more"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+
+	// Shallow fetches need a file:// URL rather than a plain path
+	os.MkdirAll(monoDir, 0755)
+	runGitCmd(t, monoDir, "init")
+	runGitCmd(t, monoDir, "config", "user.name", "Test User")
+	runGitCmd(t, monoDir, "config", "user.email", "test@example.com")
+	runGitCmd(t, monoDir, "remote", "add", "repo1", "file://"+repo1Dir)
+	runGitCmd(t, monoDir, "remote", "add", "repo2", "file://"+repo2Dir)
+	runGitCmd(t, monoDir, "fetch", "--depth=1", "repo1")
+	runGitCmd(t, monoDir, "fetch", "repo2")
+
+	output := runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")
+	if !strings.Contains(output, "repository is shallow") || !strings.Contains(output, "-unshallow") {
+		t.Errorf("Expected a shallow repository warning, got: %s", output)
+	}
+
+	output = runGitStitch(t, monoDir, "-unshallow", "repo1/master", "repo2/master")
+	if strings.Contains(output, "repository is shallow") {
+		t.Errorf("Expected no shallow warning after -unshallow, got: %s", output)
+	}
+	if shallow := gitOutput(t, monoDir, "rev-parse", "--is-shallow-repository"); shallow != "false" {
+		t.Errorf("Expected -unshallow to fetch complete history, but the repository is still shallow")
+	}
+	stitchHash := extractCommitHash(output)
+
+	// A shallow clone of the monorepo that stops short of the base commit
+	checkoutCommit(t, monoDir, "mono", stitchHash)
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo1")
+	cloneDir := filepath.Join(testDir, "clone")
+	runGitCmd(t, testDir, "clone", "--depth=1", "--branch=mono", "file://"+monoDir, cloneDir)
+
+	code, output := runToolExitCode(t, cloneDir, "git-rip", "shallow")
+	if code != 3 || !strings.Contains(output, "shallow") || !strings.Contains(output, "git fetch --unshallow") {
+		t.Errorf("Expected exit code 3 and a hint about the shallow clone, got %d: %s", code, output)
+	}
+}
+
+func testSignedStitch(t *testing.T, baseDir string) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not available")
+	}
+
+	testDir := filepath.Join(baseDir, "signed")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+	gnupgHome := filepath.Join(testDir, "gnupg")
+	os.MkdirAll(gnupgHome, 0700)
+	gpgEnv := []string{"GNUPGHOME=" + gnupgHome}
+
+	cmd := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key", "Stitch Test <stitch@example.com>", "default", "default", "never")
+	cmd.Env = append(os.Environ(), gpgEnv...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("couldn't generate a gpg key: %v, output: %s", err, output)
+	}
+	defer exec.Command("gpgconf", "--homedir", gnupgHome, "--kill", "gpg-agent").Run()
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+	runGitCmd(t, monoDir, "config", "stitch.signing-key", "stitch@example.com")
+
+	unsignedHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master"))
+
+	signedHash := extractCommitHash(runToolEnv(t, monoDir, "git-stitch", gpgEnv, "-no-fetch", "-sign", "repo1/master", "repo2/master"))
+	runGitCmdEnv(t, monoDir, gpgEnv, "verify-commit", signedHash)
+	if signedHash == unsignedHash {
+		t.Errorf("Expected the signed commit to differ from the unsigned one")
+	}
+	if signedTree, unsignedTree := gitOutput(t, monoDir, "rev-parse", signedHash+"^{tree}"), gitOutput(t, monoDir, "rev-parse", unsignedHash+"^{tree}"); signedTree != unsignedTree {
+		t.Errorf("Expected signing to leave the tree alone, got %s and %s", signedTree, unsignedTree)
+	}
+
+	runGitCmd(t, monoDir, "config", "stitch.sign", "true")
+	configHash := extractCommitHash(runToolEnv(t, monoDir, "git-stitch", gpgEnv, "-no-fetch", "repo1/master", "repo2/master"))
+	runGitCmdEnv(t, monoDir, gpgEnv, "verify-commit", configHash)
+
+	if hash := extractCommitHash(runToolEnv(t, monoDir, "git-stitch", gpgEnv, "-no-fetch", "-sign=false", "repo1/master", "repo2/master")); hash != unsignedHash {
+		t.Errorf("Expected -sign=false to override stitch.sign, got %s instead of %s", hash, unsignedHash)
+	}
+}
+
+func testStitchStats(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "stats")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+		{Message: "Add source", Files: map[string]string{"src/main.go": "package main\n", "src/util.go": "package main // util\n"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2 is longer"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	output := runGitStitch(t, monoDir, "-no-fetch", "-stats", "repo1/master", "repo2/master")
+	for _, expected := range []string{
+		"repo1: 3 blobs, 42 bytes\n",
+		"repo2: 1 blobs, 18 bytes\n",
+		"Total: 4 blobs, 60 bytes in tree ",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected stats output to contain %q, got: %s", expected, output)
+		}
+	}
+	if strings.Contains(output, "Stitched") {
+		t.Errorf("Expected -stats not to create a commit, got: %s", output)
+	}
+}
+
+func testCrossRemoteMove(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "cross-remote-move")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1", "shared/util.go": "package util\n"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	checkoutCommit(t, monoDir, "mono", extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")))
+	os.MkdirAll(filepath.Join(monoDir, "repo2", "lib"), 0755)
+	runGitCmd(t, monoDir, "mv", "repo1/shared/util.go", "repo2/lib/util.go")
+	runGitCmd(t, monoDir, "commit", "-m", "Move util to repo2")
+
+	runGitRip(t, monoDir, "moved")
+
+	if files := gitOutput(t, monoDir, "ls-tree", "-r", "--name-only", "moved-repo1"); strings.Contains(files, "util.go") {
+		t.Errorf("Expected util.go to be deleted from moved-repo1, got files: %s", files)
+	}
+	if blob, original := gitOutput(t, monoDir, "rev-parse", "moved-repo2:lib/util.go"), gitOutput(t, monoDir, "rev-parse", "repo1/master:shared/util.go"); blob != original {
+		t.Errorf("Expected lib/util.go on moved-repo2 to keep its content, got blob %s instead of %s", blob, original)
+	}
+	for _, branch := range []string{"moved-repo1", "moved-repo2"} {
+		if subject := gitOutput(t, monoDir, "log", "-1", "--format=%s", branch); subject != "Move util to repo2" {
+			t.Errorf("Expected %s to have the move commit, got %q", branch, subject)
+		}
+	}
+}
+
+func testStitchTreeFilter(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "tree-filter")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1", "src/secret.txt": "hunter2"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	// The remote's own .gitignore doesn't apply to what the filter writes
+	writeFile(t, filepath.Join(repo1Dir, ".gitignore"), "*.log\n")
+	commitChanges(t, repo1Dir, "Ignore logs")
+	runGitCmd(t, monoDir, "fetch", "repo1")
+
+	filter := `mv README.md README.txt && rm -f src/secret.txt && echo "$STITCH_REMOTE" > remote.txt && echo kept > filter.log`
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "-tree-filter", filter, "repo1/master", "repo2/master"))
+
+	files := gitOutput(t, monoDir, "ls-tree", "-r", "--name-only", stitchHash)
+	expected := "repo1/.gitignore\nrepo1/README.txt\nrepo1/filter.log\nrepo1/remote.txt\nrepo2/README.txt\nrepo2/filter.log\nrepo2/remote.txt"
+	if files != expected {
+		t.Errorf("Expected filtered files %q, got %q", expected, files)
+	}
+	if content := gitOutput(t, monoDir, "show", stitchHash+":repo1/README.txt"); content != "# Repo 1" {
+		t.Errorf("Expected renamed file to keep its content, got %q", content)
+	}
+	if content := gitOutput(t, monoDir, "show", stitchHash+":repo2/remote.txt"); content != "repo2" {
+		t.Errorf("Expected $STITCH_REMOTE to be repo2, got %q", content)
+	}
+	if parent := gitOutput(t, monoDir, "rev-parse", stitchHash+"^1"); parent != gitOutput(t, monoDir, "rev-parse", "repo1/master") {
+		t.Errorf("Expected the parents to be the unfiltered commits, got %s", parent)
+	}
+
+	code, output := runToolExitCode(t, monoDir, "git-stitch", "-no-fetch", "-tree-filter", "exit 7", "repo1/master", "repo2/master")
+	if code != 1 || !strings.Contains(output, "-tree-filter failed") {
+		t.Errorf("Expected a failing filter to stop the stitch, got %d: %s", code, output)
+	}
+}
+
+func testNestedRemoteNames(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "nested-remotes")
+	os.MkdirAll(testDir, 0755)
+
+	repoADir := filepath.Join(testDir, "a")
+	repoBDir := filepath.Join(testDir, "b")
+	appDir := filepath.Join(testDir, "app")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repoADir, "a", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"a.txt": "a"}},
+	})
+	createTestRepo(t, repoBDir, "b", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"b.txt": "b"}},
+	})
+	createTestRepo(t, appDir, "app", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"main.go": "package main"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"vendor/a": repoADir,
+		"vendor/b": repoBDir,
+		"app":      appDir,
+	})
+
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "vendor/a/master", "vendor/b/master", "app/master"))
+
+	if entries := gitOutput(t, monoDir, "ls-tree", "--name-only", stitchHash); entries != "app\nvendor" {
+		t.Errorf("Expected top-level app and vendor, got %q", entries)
+	}
+	if entries := gitOutput(t, monoDir, "ls-tree", "--name-only", stitchHash+":vendor"); entries != "a\nb" {
+		t.Errorf("Expected vendor to contain a and b, got %q", entries)
+	}
+	if tree, expected := gitOutput(t, monoDir, "rev-parse", stitchHash+":vendor/a"), gitOutput(t, monoDir, "rev-parse", "vendor/a/master^{tree}"); tree != expected {
+		t.Errorf("Expected vendor/a to be vendor/a/master's tree %s, got %s", expected, tree)
+	}
+
+	checkoutCommit(t, monoDir, "mono", stitchHash)
+	writeFile(t, filepath.Join(monoDir, "vendor", "b", "b.txt"), "b changed")
+	commitChanges(t, monoDir, "Change vendor/b")
+
+	runGitRip(t, monoDir, "nested")
+	if content := gitOutput(t, monoDir, "show", "nested-vendor/b:b.txt"); content != "b changed" {
+		t.Errorf("Expected nested-vendor/b to have the change, got %q", content)
+	}
+	if parent, expected := gitOutput(t, monoDir, "rev-parse", "nested-vendor/b^"), gitOutput(t, monoDir, "rev-parse", "vendor/b/master"); parent != expected {
+		t.Errorf("Expected nested-vendor/b to build on vendor/b/master %s, got %s", expected, parent)
+	}
+
+	runGitCmd(t, monoDir, "remote", "add", "vendor", repoADir)
+	runGitCmd(t, monoDir, "fetch", "vendor")
+	if code, output := runToolExitCode(t, monoDir, "git-stitch", "-no-fetch", "vendor/master", "vendor/b/master"); code != 2 {
+		t.Errorf("Expected exit code 2 when one remote would contain another, got %d: %s", code, output)
+	}
+}
+
+func testRipNotes(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "notes")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	checkoutCommit(t, monoDir, "mono", extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")))
+	writeFile(t, filepath.Join(monoDir, "repo1", "both.txt"), "both")
+	writeFile(t, filepath.Join(monoDir, "repo2", "both.txt"), "both")
+	commitChanges(t, monoDir, "Change both")
+	bothCommit := gitOutput(t, monoDir, "rev-parse", "HEAD")
+	writeFile(t, filepath.Join(monoDir, "repo2", "only.txt"), "only")
+	commitChanges(t, monoDir, "Change repo2")
+	onlyCommit := gitOutput(t, monoDir, "rev-parse", "HEAD")
+
+	runGitRip(t, monoDir, "-notes", "noted")
+	expected := fmt.Sprintf("repo1: %s\nrepo2: %s", gitOutput(t, monoDir, "rev-parse", "noted-repo1"), gitOutput(t, monoDir, "rev-parse", "noted-repo2~1"))
+	if note := gitOutput(t, monoDir, "notes", "--ref=stitch", "show", bothCommit); note != expected {
+		t.Errorf("Expected note %q on %s, got %q", expected, bothCommit, note)
+	}
+	expected = "repo2: " + gitOutput(t, monoDir, "rev-parse", "noted-repo2")
+	if note := gitOutput(t, monoDir, "notes", "--ref=stitch", "show", onlyCommit); note != expected {
+		t.Errorf("Expected note %q on %s, got %q", expected, onlyCommit, note)
+	}
+
+	runGitRip(t, monoDir, "-notes=refs/notes/custom", "custom")
+	expected = "repo2: " + gitOutput(t, monoDir, "rev-parse", "custom-repo2")
+	if note := gitOutput(t, monoDir, "notes", "--ref=refs/notes/custom", "show", onlyCommit); note != expected {
+		t.Errorf("Expected note %q in refs/notes/custom, got %q", expected, note)
+	}
+}
+
+func testNarrowFetchRefspec(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "narrow-refspec")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	runGitCmd(t, repo1Dir, "branch", "other")
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+
+	os.MkdirAll(monoDir, 0755)
+	runGitCmd(t, monoDir, "init")
+	runGitCmd(t, monoDir, "remote", "add", "repo1", repo1Dir)
+	runGitCmd(t, monoDir, "remote", "add", "repo2", repo2Dir)
+	runGitCmd(t, monoDir, "config", "remote.repo1.fetch", "+refs/heads/other:refs/remotes/repo1/other")
+
+	output := runGitStitch(t, monoDir, "repo1/master", "repo2/master")
+	if !strings.Contains(output, "fetch refspec doesn't cover repo1/master") {
+		t.Errorf("Expected a warning about the narrow refspec, got: %s", output)
+	}
+	if hash, expected := gitOutput(t, monoDir, "rev-parse", "repo1/master"), gitOutput(t, repo1Dir, "rev-parse", "master"); hash != expected {
+		t.Errorf("Expected repo1/master to be fetched as %s, got %s", expected, hash)
+	}
+
+	code, output := runToolExitCode(t, monoDir, "git-stitch", "repo1/missing", "repo2/master")
+	if code != 3 || !strings.Contains(output, "fetching refs/heads/missing from repo1 failed") {
+		t.Errorf("Expected exit code 3 explaining the failed fetch, got %d: %s", code, output)
+	}
+}
+
+func testRipCommitterDateNow(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "committer-date")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	checkoutCommit(t, monoDir, "mono", extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")))
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	runGitCmd(t, monoDir, "add", ".")
+	runGitCmdEnv(t, monoDir, []string{"GIT_AUTHOR_DATE=1000000000 +0100", "GIT_COMMITTER_DATE=1000000100 +0100"}, "commit", "-m", "Old change")
+
+	runGitRip(t, monoDir, "original")
+	if dates := gitOutput(t, monoDir, "log", "-1", "--format=%at %ct", "original-repo1"); dates != "1000000000 1000000100" {
+		t.Errorf("Expected original dates by default, got %s", dates)
+	}
+
+	start := time.Now().Unix()
+	runGitRip(t, monoDir, "-committer-date", "now", "fresh")
+	dates := strings.Fields(gitOutput(t, monoDir, "log", "-1", "--format=%at %ct", "fresh-repo1"))
+	if dates[0] != "1000000000" {
+		t.Errorf("Expected the author date to be kept, got %s", dates[0])
+	}
+	if committed, _ := strconv.ParseInt(dates[1], 10, 64); committed < start {
+		t.Errorf("Expected a committer date no earlier than %d, got %s", start, dates[1])
+	}
+
+	if code, output := runToolExitCode(t, monoDir, "git-rip", "-committer-date", "yesterday", "bad"); code != 2 {
+		t.Errorf("Expected exit code 2 for an unknown -committer-date, got %d: %s", code, output)
+	}
+}
+
+func testStitchGitConfig(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "git-config")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+
+	// These URLs only work once the insteadOf rewrite is applied
+	os.MkdirAll(monoDir, 0755)
+	runGitCmd(t, monoDir, "init")
+	runGitCmd(t, monoDir, "remote", "add", "repo1", "stitchtest:repo1")
+	runGitCmd(t, monoDir, "remote", "add", "repo2", "stitchtest:repo2")
+	rewrite := "url." + testDir + "/.insteadOf=stitchtest:"
+
+	if code, output := runToolExitCode(t, monoDir, "git-stitch", "repo1/master", "repo2/master"); code == 0 {
+		t.Fatalf("Expected fetching without the rewrite to fail, got: %s", output)
+	}
+
+	output := runGitStitch(t, monoDir, "-git-config", rewrite, "-git-config", "fetch.prune=true", "repo1/master", "repo2/master")
+	if !strings.Contains(output, "Stitched repo1 & repo2") {
+		t.Errorf("Expected the stitch to succeed with -git-config, got: %s", output)
+	}
+	if url := gitOutput(t, monoDir, "config", "--get", "remote.repo1.url"); url != "stitchtest:repo1" {
+		t.Errorf("Expected -git-config not to change the repository's config, got url %s", url)
+	}
+
+	if code, output := runToolExitCode(t, monoDir, "git-stitch", "-git-config", "novalue", "repo1/master"); code != 2 {
+		t.Errorf("Expected exit code 2 for a -git-config without =, got %d: %s", code, output)
+	}
+}
+
+func testBaseMarker(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "base-marker")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	// A custom subject with the default marker
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "-m", "Import repo1 and repo2", "repo1/master", "repo2/master"))
+	if subject := gitOutput(t, monoDir, "show", "-s", "--format=%s", stitchHash); subject != "Import repo1 and repo2" {
+		t.Errorf("Expected the custom subject, got %q", subject)
+	}
+	if marker := gitOutput(t, monoDir, "show", "-s", "--format=%(trailers:key=Stitch-Base,valueonly)", stitchHash); marker != "git-stitch merge" {
+		t.Errorf("Expected the default marker trailer, got %q", marker)
+	}
+	checkoutCommit(t, monoDir, "mono", stitchHash)
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo1")
+	// Mentioning the marker, even on a line of its own that looks like the
+	// trailer, doesn't make a commit the base
+	writeFile(t, filepath.Join(monoDir, "repo1", "notes.txt"), "notes")
+	commitChanges(t, monoDir, "Add notes\n\nFollow-up to the git-stitch merge.\nStitch-Base: git-stitch merge, see above\n\nReviewed-by: Someone <someone@example.com>")
+	runGitRip(t, monoDir, "subject")
+	if parent, expected := gitOutput(t, monoDir, "rev-parse", "subject-repo1~2"), gitOutput(t, monoDir, "rev-parse", "repo1/master"); parent != expected {
+		t.Errorf("Expected subject-repo1 to build on repo1/master %s, got %s", expected, parent)
+	}
+	if log := gitOutput(t, monoDir, "log", "--format=%s", "--reverse", "repo1/master..subject-repo1"); log != "Change repo1\nAdd notes" {
+		t.Errorf("Expected both commits after the base to be ripped, got:\n%s", log)
+	}
+
+	// A custom marker, which must match between git-stitch and git-rip
+	runGitCmd(t, monoDir, "config", "stitch.base-marker", "acme-monorepo-base")
+	stitchHash = extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "-m", "Acme monorepo", "repo1/master", "repo2/master"))
+	runGitCmd(t, monoDir, "checkout", "-b", "acme", stitchHash)
+	writeFile(t, filepath.Join(monoDir, "repo2", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo2")
+	runGitRip(t, monoDir, "marker")
+	if parent, expected := gitOutput(t, monoDir, "rev-parse", "marker-repo2^"), gitOutput(t, monoDir, "rev-parse", "repo2/master"); parent != expected {
+		t.Errorf("Expected marker-repo2 to build on repo2/master %s, got %s", expected, parent)
+	}
+
+	runGitCmd(t, monoDir, "config", "stitch.base-marker", "some-other-marker")
+	code, output := runToolExitCode(t, monoDir, "git-rip", "missing")
+	if code != 3 || !strings.Contains(output, "some-other-marker") {
+		t.Errorf("Expected exit code 3 naming the marker, got %d: %s", code, output)
+	}
+}
+
+func testRipTiming(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "timing")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	checkoutCommit(t, monoDir, "mono", extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master")))
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo1")
+
+	output := runGitRip(t, monoDir, "-timing", "timed")
+	var elapsed string
+	var count int
+	for _, line := range strings.Split(output, "\n") {
+		if _, err := fmt.Sscanf(line, "Finished in %s running %d git commands", &elapsed, &count); err == nil {
+			break
+		}
+	}
+	if count == 0 {
+		t.Errorf("Expected a non-zero git command count, got: %s", output)
+	}
+
+	if output := runGitRip(t, monoDir, "untimed"); strings.Contains(output, "Finished in") {
+		t.Errorf("Expected no timing output without -timing, got: %s", output)
+	}
+}
+
+func testRipExcludeCommit(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "exclude-commit")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master"))
+	checkoutCommit(t, monoDir, "mono", stitchHash)
+	writeFile(t, filepath.Join(monoDir, "repo1", "first.txt"), "first")
+	commitChanges(t, monoDir, "First")
+	writeFile(t, filepath.Join(monoDir, "repo1", "experiment.txt"), "experiment")
+	writeFile(t, filepath.Join(monoDir, "repo2", "experiment.txt"), "experiment")
+	commitChanges(t, monoDir, "Experiment")
+	experiment := gitOutput(t, monoDir, "rev-parse", "--short", "HEAD")
+	writeFile(t, filepath.Join(monoDir, "repo1", "last.txt"), "last")
+	commitChanges(t, monoDir, "Last")
+
+	output := runGitRip(t, monoDir, "-exclude-commit", experiment, "excluded")
+	if !strings.Contains(output, "Skipping excluded commit") {
+		t.Errorf("Expected the excluded commit to be reported, got: %s", output)
+	}
+	if log := gitOutput(t, monoDir, "log", "--format=%s", "repo1/master..excluded-repo1"); log != "Last\nFirst" {
+		t.Errorf("Expected only First and Last on excluded-repo1, got %q", log)
+	}
+	if files := gitOutput(t, monoDir, "ls-tree", "--name-only", "excluded-repo1"); strings.Contains(files, "experiment.txt") {
+		t.Errorf("Expected experiment.txt to be left out of excluded-repo1, got files: %s", files)
+	}
+	if head, original := gitOutput(t, monoDir, "rev-parse", "excluded-repo2"), gitOutput(t, monoDir, "rev-parse", "repo2/master"); head != original {
+		t.Errorf("Expected excluded-repo2 to stay at repo2/master, got %s", head)
+	}
+
+	for _, commit := range []string{stitchHash, "0000000000000000000000000000000000000000"} {
+		if code, output := runToolExitCode(t, monoDir, "git-rip", "-exclude-commit", commit, "bad"); code != 2 {
+			t.Errorf("Expected exit code 2 excluding %s, got %d: %s", commit, code, output)
+		}
+	}
+}
+
+func testStitchDirOverride(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "dir-override")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "-dir", "repo1=services/one/", "repo1/master", "repo2/master"))
+	if files := gitOutput(t, monoDir, "ls-tree", "-r", "--name-only", stitchHash); files != "repo2/README.md\nservices/one/README.md" {
+		t.Errorf("Expected repo1 under services/one and repo2 in its default directory, got %q", files)
+	}
+	expected := "Stitch-Parent: services/one " + gitOutput(t, monoDir, "rev-parse", "repo1/master")
+	if trailers := gitOutput(t, monoDir, "show", "-s", "--format=%(trailers:key=Stitch-Parent)", stitchHash); !strings.Contains(trailers, expected) {
+		t.Errorf("Expected trailer %q, got %q", expected, trailers)
+	}
+
+	checkoutCommit(t, monoDir, "mono", stitchHash)
+	writeFile(t, filepath.Join(monoDir, "services", "one", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo1")
+	runGitRip(t, monoDir, "dir")
+	if parent, expected := gitOutput(t, monoDir, "rev-parse", "dir-services/one^"), gitOutput(t, monoDir, "rev-parse", "repo1/master"); parent != expected {
+		t.Errorf("Expected dir-services/one to build on repo1/master %s, got %s", expected, parent)
+	}
+
+	// Windows-style separators are converted
+	backslashHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "-dir", `repo1=services\one`, "repo1/master", "repo2/master"))
+	if tree, expected := gitOutput(t, monoDir, "rev-parse", backslashHash+"^{tree}"), gitOutput(t, monoDir, "rev-parse", stitchHash+"^{tree}"); tree != expected {
+		t.Errorf("Expected services\\one to stitch into services/one, got tree %s instead of %s", tree, expected)
+	}
+
+	for _, override := range []string{"repo3=x", "repo1=../outside", `repo1=..\outside`, "repo1=/abs", `repo1=C:\abs`, "repo1=repo2", "repo1=repo2/inner", "repo1"} {
+		if code, output := runToolExitCode(t, monoDir, "git-stitch", "-no-fetch", "-dir", override, "repo1/master", "repo2/master"); code != 2 {
+			t.Errorf("Expected exit code 2 for -dir %s, got %d: %s", override, code, output)
+		}
+	}
+}
+
+func testVersion(t *testing.T, baseDir string) {
+	format := regexp.MustCompile(`^(git-stitch|git-rip) (\S+ \(commit \S+, built \S+, go\S+\))\n$`)
+	versionOf := func(binary string) string {
+		cmd := exec.Command(binary, "-version")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s -version failed: %v, output: %s", binary, err, output)
+		}
+		match := format.FindStringSubmatch(string(output))
+		if match == nil {
+			t.Fatalf("Unexpected version output from %s: %q", binary, output)
+		}
+		return match[2]
+	}
+
+	testDir := filepath.Join(baseDir, "version")
+	os.MkdirAll(testDir, 0755)
+	build := func(dir, ldflags string) {
+		os.MkdirAll(dir, 0755)
+		for _, tool := range []string{"git-stitch", "git-rip"} {
+			if output, err := exec.Command("go", "build", "-ldflags", ldflags, "-o", filepath.Join(dir, tool), "./cmd/"+tool).CombinedOutput(); err != nil {
+				t.Fatalf("Failed to build %s: %v, output: %s", tool, err, output)
+			}
+		}
+	}
+
+	// Built from the same tree outside the checkout, so that neither build
+	// sees the other's binary as an untracked file
+	plainDir := filepath.Join(testDir, "plain")
+	build(plainDir, "")
+	if stitch, rip := versionOf(filepath.Join(plainDir, "git-stitch")), versionOf(filepath.Join(plainDir, "git-rip")); stitch != rip {
+		t.Errorf("Expected both tools to report the same version, got %q and %q", stitch, rip)
+	}
+
+	// Values set at link time take precedence over the embedded build info
+	linkedDir := filepath.Join(testDir, "linked")
+	build(linkedDir, "-X github.com/philz/git-stitch/internal/version.Version=v9.8.7"+
+		" -X github.com/philz/git-stitch/internal/version.Commit=abc123"+
+		" -X github.com/philz/git-stitch/internal/version.Date=2024-01-02T03:04:05Z")
+	for _, tool := range []string{"git-stitch", "git-rip"} {
+		if version := versionOf(filepath.Join(linkedDir, tool)); !strings.HasPrefix(version, "v9.8.7 (commit abc123, built 2024-01-02T03:04:05Z, go") {
+			t.Errorf("Expected %s to report the linked version, got %q", tool, version)
+		}
+	}
+}
+
+func testCaseCollisions(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "case-collisions")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	args := []string{"-no-fetch", "-dir", "repo1=API", "-dir", "repo2=api", "repo1/master", "repo2/master"}
+	code, output := runToolExitCode(t, monoDir, "git-stitch", args...)
+	if code != 1 {
+		t.Fatalf("Expected exit code 1 for colliding directories, got %d: %s", code, output)
+	}
+	if !strings.Contains(output, "paths differ only in case: API, api\n") {
+		t.Errorf("Expected the collision between API and api to be reported, got: %s", output)
+	}
+	if strings.Contains(output, "README.md") {
+		t.Errorf("Expected only the colliding directories to be reported, got: %s", output)
+	}
+
+	output = runGitStitch(t, monoDir, append([]string{"-allow-case-collisions"}, args...)...)
+	if !strings.Contains(output, "Warning: paths differ only in case: API, api") {
+		t.Errorf("Expected a warning with -allow-case-collisions, got: %s", output)
+	}
+	if files := gitOutput(t, monoDir, "ls-tree", "-r", "--name-only", extractCommitHash(output)); files != "API/README.md\napi/README.md" {
+		t.Errorf("Expected both directories to be stitched, got %q", files)
+	}
+}
+
+func testRipFsck(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "rip-fsck")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master"))
+	checkoutCommit(t, monoDir, "mono", stitchHash)
+	writeFile(t, filepath.Join(monoDir, "repo1", "one.txt"), "one")
+	writeFile(t, filepath.Join(monoDir, "repo2", "two.txt"), "two")
+	commitChanges(t, monoDir, "Change both")
+	runGitRip(t, monoDir, "fs")
+
+	if output := runGitRip(t, monoDir, "-fsck", "fs"); !strings.Contains(output, "All 2 branches with prefix fs match HEAD") {
+		t.Errorf("Expected fsck to pass right after ripping, got: %s", output)
+	}
+
+	// Tamper with one branch
+	checkoutBranch(t, monoDir, "fs-repo1")
+	writeFile(t, filepath.Join(monoDir, "tampered.txt"), "tampered")
+	commitChanges(t, monoDir, "Tamper")
+	checkoutBranch(t, monoDir, "mono")
+
+	code, output := runToolExitCode(t, monoDir, "git-rip", "-fsck", "fs")
+	if code != 1 {
+		t.Fatalf("Expected exit code 1 for a tampered branch, got %d: %s", code, output)
+	}
+	if !strings.Contains(output, "repo1: branch fs-repo1 differs from HEAD:repo1\nA\ttampered.txt") {
+		t.Errorf("Expected the tampered file to be reported, got: %s", output)
+	}
+	if strings.Contains(output, "repo2:") {
+		t.Errorf("Expected repo2 to match, got: %s", output)
+	}
+
+	if code, output := runToolExitCode(t, monoDir, "git-rip", "-fsck", "nope"); code != 1 || !strings.Contains(output, "branch nope-repo1 doesn't exist") {
+		t.Errorf("Expected missing branches to be reported, got %d: %s", code, output)
+	}
+	if code, output := runToolExitCode(t, monoDir, "git-rip", "-fsck"); code != 2 {
+		t.Errorf("Expected exit code 2 for -fsck without a prefix, got %d: %s", code, output)
+	}
+}
+
+func testStitchNoParents(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "no-parents")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	merged := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "repo2/master"))
+	root := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "-no-parents", "repo1/master", "repo2/master"))
+
+	if parents := gitOutput(t, monoDir, "rev-list", "--parents", "-n", "1", root); parents != root {
+		t.Errorf("Expected a parentless commit, got %q", parents)
+	}
+	if tree, expected := gitOutput(t, monoDir, "rev-parse", root+"^{tree}"), gitOutput(t, monoDir, "rev-parse", merged+"^{tree}"); tree != expected {
+		t.Errorf("Expected the same tree as a normal stitch %s, got %s", expected, tree)
+	}
+	if trailers := gitOutput(t, monoDir, "show", "-s", "--format=%(trailers:key=Stitch-Parent)", root); trailers != "" {
+		t.Errorf("Expected no Stitch-Parent trailers, got %q", trailers)
+	}
+
+	checkoutCommit(t, monoDir, "mono", root)
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo1")
+	code, output := runToolExitCode(t, monoDir, "git-rip", "np")
+	if code != 3 || !strings.Contains(output, "has no parents") {
+		t.Errorf("Expected git-rip to refuse a parentless base with exit code 3, got %d: %s", code, output)
+	}
+
+	if code, output := runToolExitCode(t, monoDir, "git-stitch", "-no-fetch", "-no-parents", "-primary", "repo1", "repo1/master", "repo2/master"); code != 2 {
+		t.Errorf("Expected exit code 2 for -primary with -no-parents, got %d: %s", code, output)
+	}
+}
+
+func testStitchPinnedCommit(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "pinned-commit")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+		{Message: "Add feature", Files: map[string]string{"feature.txt": "feature1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	pinned := gitOutput(t, monoDir, "rev-parse", "repo1/master^")
+	for _, args := range [][]string{
+		{"-no-fetch", "repo1/" + pinned, "repo2/master"},
+		{"repo1/" + pinned, "repo2/master"},
+	} {
+		stitchHash := extractCommitHash(runGitStitch(t, monoDir, args...))
+		if tree, expected := gitOutput(t, monoDir, "rev-parse", stitchHash+":repo1"), gitOutput(t, monoDir, "rev-parse", pinned+"^{tree}"); tree != expected {
+			t.Errorf("%v: expected repo1 to have the pinned commit's tree %s, got %s", args, expected, tree)
+		}
+		if parents := gitOutput(t, monoDir, "rev-list", "--parents", "-n", "1", stitchHash); !strings.Contains(parents, pinned) {
+			t.Errorf("%v: expected the pinned commit %s as a parent, got %s", args, pinned, parents)
+		}
+	}
+
+	missing := strings.Repeat("0", 40)
+	if code, output := runToolExitCode(t, monoDir, "git-stitch", "-no-fetch", "repo1/"+missing, "repo2/master"); code != 3 {
+		t.Errorf("Expected exit code 3 for a commit that doesn't exist, got %d: %s", code, output)
+	}
+}
+
+func testRipPrefixTimestampFormat(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "prefix-timestamp-format")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{"repo1": repo1Dir})
+
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master"))
+	checkoutCommit(t, monoDir, "mono", stitchHash)
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	commitChanges(t, monoDir, "Change repo1")
+
+	// The space and colons aren't allowed in branch names
+	runGitRip(t, monoDir, "-prefix-timestamp-format", "snap 2006:01:02")
+	branches := gitOutput(t, monoDir, "for-each-ref", "--format=%(refname:short)", "refs/heads/snap*")
+	if !regexp.MustCompile(`^snap-\d{4}-\d{2}-\d{2}-repo1$`).MatchString(branches) {
+		t.Errorf("Expected a branch named after the formatted date, got %q", branches)
+	}
+
+	// An explicit prefix wins
+	runGitRip(t, monoDir, "-prefix-timestamp-format", "ignored-2006", "explicit")
+	verifyBranchExists(t, monoDir, "explicit-repo1")
+	if branches := gitOutput(t, monoDir, "for-each-ref", "refs/heads/ignored*"); branches != "" {
+		t.Errorf("Expected no branches from the timestamp format, got %q", branches)
+	}
+}
+
+func testSubmodules(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "submodules")
+	os.MkdirAll(testDir, 0755)
+
+	libDir := filepath.Join(testDir, "lib")
+	repo1Dir := filepath.Join(testDir, "repo1")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, libDir, "lib", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"lib.txt": "v1"}},
+		{Message: "Update", Files: map[string]string{"lib.txt": "v2"}},
+	})
+	oldLib := gitOutput(t, libDir, "rev-parse", "HEAD^")
+	newLib := gitOutput(t, libDir, "rev-parse", "HEAD")
+
+	// A gitlink, without the submodule's objects, as a clone without
+	// --recurse-submodules would have it
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{
+			"README.md":   "# Repo 1",
+			".gitmodules": "[submodule \"lib\"]\n\tpath = lib\n\turl = ../lib\n",
+		}},
+	})
+	runGitCmd(t, repo1Dir, "update-index", "--add", "--cacheinfo", "160000,"+oldLib+",lib")
+	runGitCmd(t, repo1Dir, "commit", "-m", "Add lib submodule")
+	setupMonoRepo(t, monoDir, map[string]string{"repo1": repo1Dir})
+
+	for _, args := range [][]string{
+		{"-no-fetch", "repo1/master"},
+		{"-no-fetch", "-tree-filter", "true", "repo1/master"},
+	} {
+		stitchHash := extractCommitHash(runGitStitch(t, monoDir, args...))
+		if entry := gitOutput(t, monoDir, "ls-tree", stitchHash, "repo1/lib"); entry != "160000 commit "+oldLib+"\trepo1/lib" {
+			t.Errorf("%v: expected the gitlink to be stitched as is, got %q", args, entry)
+		}
+	}
+
+	// Move the submodule forward in the monorepo, and rip it
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master"))
+	checkoutCommit(t, monoDir, "mono", stitchHash)
+	runGitCmd(t, monoDir, "update-index", "--cacheinfo", "160000,"+newLib+",repo1/lib")
+	runGitCmd(t, monoDir, "commit", "-m", "Update lib")
+	runGitRip(t, monoDir, "sub")
+
+	if entry := gitOutput(t, monoDir, "ls-tree", "sub-repo1", "lib"); entry != "160000 commit "+newLib+"\tlib" {
+		t.Errorf("Expected the ripped branch to move the gitlink to %s, got %q", newLib, entry)
+	}
+	if output := runGitRip(t, monoDir, "-fsck", "sub"); !strings.Contains(output, "match HEAD") {
+		t.Errorf("Expected the ripped branch to match HEAD, got: %s", output)
+	}
+}
+
+func testParallelFetch(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "parallel-fetch")
+	os.MkdirAll(testDir, 0755)
+
+	monoDir := filepath.Join(testDir, "mono")
+	remotes := make(map[string]string)
+	var refs []string
+	for _, name := range []string{"repo1", "repo2", "repo3"} {
+		repoDir := filepath.Join(testDir, name)
+		createTestRepo(t, repoDir, name, []TestCommit{
+			{Message: "Initial commit", Files: map[string]string{"README.md": "# " + name}},
+		})
+		remotes[name] = repoDir
+		refs = append(refs, name+"/master")
+	}
+	setupMonoRepo(t, monoDir, remotes)
+
+	// New commits that only a fetch will bring in
+	for name, repoDir := range remotes {
+		writeFile(t, filepath.Join(repoDir, "new.txt"), "new")
+		commitChanges(t, repoDir, "New commit in "+name)
+	}
+
+	output := runGitStitch(t, monoDir, append([]string{"-jobs", "3"}, refs...)...)
+	stitchHash := extractCommitHash(output)
+	for name, repoDir := range remotes {
+		if tree, expected := gitOutput(t, monoDir, "rev-parse", stitchHash+":"+name), gitOutput(t, repoDir, "rev-parse", "HEAD^{tree}"); tree != expected {
+			t.Errorf("Expected %s to be fetched and stitched at tree %s, got %s", name, expected, tree)
+		}
+	}
+	// Output comes in the order the refs were given
+	last := -1
+	for _, ref := range refs {
+		i := strings.Index(output, ref+" is ")
+		if i < last {
+			t.Errorf("Expected %s to be reported in order, got: %s", ref, output)
+		}
+		last = i
+	}
+
+	// One remote failing to fetch doesn't stop the others being reported
+	runGitCmd(t, monoDir, "remote", "add", "broken", filepath.Join(testDir, "does-not-exist"))
+	code, output := runToolExitCode(t, monoDir, "git-stitch", append([]string{"-jobs", "2", "broken/master"}, refs...)...)
+	if code == 0 {
+		t.Fatalf("Expected failure when a remote can't be fetched, got: %s", output)
+	}
+	if !strings.Contains(output, "Error: broken/master: error fetching broken") || !strings.Contains(output, "failed to resolve 1 of 4 refs: broken/master") {
+		t.Errorf("Expected the broken remote to be reported, got: %s", output)
+	}
+	for _, ref := range refs {
+		if !strings.Contains(output, ref+" is ") {
+			t.Errorf("Expected %s to still be resolved, got: %s", ref, output)
+		}
+	}
+
+	if code, output := runToolExitCode(t, monoDir, "git-stitch", "-jobs", "0", "repo1/master"); code != 2 {
+		t.Errorf("Expected exit code 2 for -jobs 0, got %d: %s", code, output)
+	}
+}
+
+func testStitchCheck(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "check")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"repo2": repo2Dir,
+	})
+
+	args := []string{"-no-fetch", "-dir", "repo2=nested/repo2", "-tree-filter", "echo filtered > FILTERED", "repo1/master", "repo2/master"}
+	output := runGitStitch(t, monoDir, append([]string{"-check"}, args...)...)
+	if !strings.Contains(output, "Stitching repo1 & repo2 is deterministic: both builds made ") {
+		t.Fatalf("Expected -check to pass, got: %s", output)
+	}
+	checked := strings.TrimSpace(output[strings.LastIndex(output, " ")+1:])
+
+	// Nothing was written to the repository
+	cmd := exec.Command("git", "cat-file", "-e", checked)
+	cmd.Dir = monoDir
+	if cmd.Run() == nil {
+		t.Errorf("Expected -check not to write %s to the repository", checked)
+	}
+
+	if stitchHash := extractCommitHash(runGitStitch(t, monoDir, args...)); stitchHash != checked {
+		t.Errorf("Expected -check to report the commit a real stitch makes, %s, got %s", stitchHash, checked)
+	}
+
+	if code, output := runToolExitCode(t, monoDir, "git-stitch", "-check", "-sign", "-no-fetch", "repo1/master"); code != 2 {
+		t.Errorf("Expected exit code 2 for -check with -sign, got %d: %s", code, output)
+	}
+}
+
+func testStitchRefsFromStdin(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "refs-from-stdin")
+	os.MkdirAll(testDir, 0755)
+
+	monoDir := filepath.Join(testDir, "mono")
+	remotes := make(map[string]string)
+	for _, name := range []string{"repo1", "repo2", "repo3"} {
+		repoDir := filepath.Join(testDir, name)
+		createTestRepo(t, repoDir, name, []TestCommit{
+			{Message: "Initial commit", Files: map[string]string{"README.md": "# " + name}},
+		})
+		remotes[name] = repoDir
+	}
+	setupMonoRepo(t, monoDir, remotes)
+
+	wd, _ := os.Getwd()
+	stitchStdin := func(stdin string, args ...string) string {
+		cmd := exec.Command(filepath.Join(wd, "git-stitch"), args...)
+		cmd.Dir = monoDir
+		cmd.Stdin = strings.NewReader(stdin)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git-stitch %v failed: %v, output: %s", args, err, output)
+		}
+		return string(output)
+	}
+
+	for _, run := range []struct {
+		stdin string
+		args  []string
+	}{
+		{"repo1/master\n\n# a comment\nrepo2/master\nrepo3/master\n", []string{"-no-fetch", "-"}},
+		{"repo1/master\nrepo2/master\nrepo3/master", []string{"-no-fetch"}},
+		{"repo2/master\nrepo3/master\n", []string{"-no-fetch", "repo1/master", "-"}},
+	} {
+		stitchHash := extractCommitHash(stitchStdin(run.stdin, run.args...))
+		for name := range remotes {
+			if parents := gitOutput(t, monoDir, "rev-list", "--parents", "-n", "1", stitchHash); !strings.Contains(parents, gitOutput(t, monoDir, "rev-parse", name+"/master")) {
+				t.Errorf("%v: expected %s to be stitched, got parents %s", run.args, name, parents)
+			}
+		}
+	}
+}
+
+func testSharedHistory(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "shared-history")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	forkDir := filepath.Join(testDir, "fork")
+	repo2Dir := filepath.Join(testDir, "repo2")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	runGitCmd(t, testDir, "clone", "-q", repo1Dir, forkDir)
+	runGitCmd(t, forkDir, "config", "user.name", "Test User")
+	runGitCmd(t, forkDir, "config", "user.email", "test@example.com")
+	writeFile(t, filepath.Join(forkDir, "fork.txt"), "fork")
+	commitChanges(t, forkDir, "Fork change")
+	createTestRepo(t, repo2Dir, "repo2", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 2"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{
+		"repo1": repo1Dir,
+		"fork":  forkDir,
+		"repo2": repo2Dir,
+	})
+	base := gitOutput(t, monoDir, "rev-parse", "repo1/master")
+
+	output := runGitStitch(t, monoDir, "-no-fetch", "repo1/master", "fork/master", "repo2/master")
+	if !strings.Contains(output, "Warning: fork and repo1 share history (merge base "+base+")") {
+		t.Errorf("Expected a warning about fork and repo1, got: %s", output)
+	}
+	if strings.Contains(output, "repo2 share") || strings.Contains(output, "and repo2") {
+		t.Errorf("Expected no warning about the unrelated repo2, got: %s", output)
+	}
+
+	code, output := runToolExitCode(t, monoDir, "git-stitch", "-no-fetch", "-strict", "repo1/master", "fork/master")
+	if code != 1 || !strings.Contains(output, "Error: fork and repo1 share history") {
+		t.Errorf("Expected -strict to fail with exit code 1, got %d: %s", code, output)
+	}
+
+	if output := runGitStitch(t, monoDir, "-no-fetch", "-strict", "repo1/master", "repo2/master"); strings.Contains(output, "share history") {
+		t.Errorf("Expected unrelated remotes to stitch quietly, got: %s", output)
+	}
+}
+
+func testRipLargeHistoryMemory(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "large-history")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{"repo1": repo1Dir})
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "repo1/master"))
+
+	// 400 commits with 256KB messages: about 100MB of history. They're
+	// monorepo-local so that ripping them is quick, but git-rip still reads
+	// every one.
+	const commits, messageSize = 400, 256 * 1024
+	padding := strings.Repeat("x", messageSize) + "\n"
+	var script strings.Builder
+	for i := 0; i < commits; i++ {
+		message := fmt.Sprintf("Commit %d\n\n%s\nMonorepo-Local: true\n", i, padding)
+		fmt.Fprintf(&script, "commit refs/heads/mono\ncommitter Test User <test@example.com> %d +0000\ndata %d\n%s", 1700000000+i, len(message), message)
+		if i == 0 {
+			fmt.Fprintf(&script, "from %s\n", stitchHash)
+		}
+		fmt.Fprintf(&script, "\n")
+	}
+	cmd := exec.Command("git", "fast-import", "--quiet")
+	cmd.Dir = monoDir
+	cmd.Stdin = strings.NewReader(script.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git fast-import failed: %v, output: %s", err, output)
+	}
+	runGitCmd(t, monoDir, "checkout", "-q", "mono")
+
+	output := runGitRip(t, monoDir, "-timing", "big")
+	if skipped := strings.Count(output, "Skipping monorepo-local commit"); skipped != commits {
+		t.Errorf("Expected all %d commits to be read, got %d", commits, skipped)
+	}
+
+	// Commits are read one at a time, so memory use shouldn't grow with
+	// the size of the history
+	match := regexp.MustCompile(`with (\d+)MB of memory`).FindStringSubmatch(output)
+	if match == nil {
+		t.Fatalf("Expected -timing to report memory use, got: %s", output)
+	}
+	if used, _ := strconv.Atoi(match[1]); used > 50 {
+		t.Errorf("Expected git-rip to use well under the history's %dMB, used %dMB", commits*messageSize/(1024*1024), used)
+	}
+}
+
+func testStitchEmptyPlaceholders(t *testing.T, baseDir string) {
+	testDir := filepath.Join(baseDir, "empty-placeholders")
+	os.MkdirAll(testDir, 0755)
+
+	repo1Dir := filepath.Join(testDir, "repo1")
+	monoDir := filepath.Join(testDir, "mono")
+
+	createTestRepo(t, repo1Dir, "repo1", []TestCommit{
+		{Message: "Initial commit", Files: map[string]string{"README.md": "# Repo 1"}},
+	})
+	setupMonoRepo(t, monoDir, map[string]string{"repo1": repo1Dir})
+
+	stitchHash := extractCommitHash(runGitStitch(t, monoDir, "-no-fetch", "-empty", "services/future", "-empty", "planned work", "repo1/master"))
+	if files := gitOutput(t, monoDir, "ls-tree", "-r", "--name-only", stitchHash); files != "planned work/.gitkeep\nrepo1/README.md\nservices/future/.gitkeep" {
+		t.Errorf("Expected placeholders with a .gitkeep, got %q", files)
+	}
+	if size := gitOutput(t, monoDir, "cat-file", "-s", stitchHash+":planned work/.gitkeep"); size != "0" {
+		t.Errorf("Expected an empty .gitkeep, got %s bytes", size)
+	}
+	if trailers := gitOutput(t, monoDir, "show", "-s", "--format=%(trailers:key=Stitch-Empty)", stitchHash); trailers != "Stitch-Empty: planned work\nStitch-Empty: services/future" {
+		t.Errorf("Expected Stitch-Empty trailers for the placeholders, got %q", trailers)
+	}
+	if parents := gitOutput(t, monoDir, "rev-list", "--parents", "-n", "1", stitchHash); parents != stitchHash+" "+gitOutput(t, monoDir, "rev-parse", "repo1/master") {
+		t.Errorf("Expected only repo1 as a parent, got %s", parents)
+	}
+
+	// Ripping leaves the placeholders alone
+	checkoutCommit(t, monoDir, "mono", stitchHash)
+	writeFile(t, filepath.Join(monoDir, "repo1", "change.txt"), "change")
+	writeFile(t, filepath.Join(monoDir, "planned work", "draft.txt"), "draft")
+	commitChanges(t, monoDir, "Change repo1 and draft planned")
+	output := runGitRip(t, monoDir, "ph")
+	if !strings.Contains(output, "changes placeholder directory planned work, which has no remote to rip to") {
+		t.Errorf("Expected a warning about the placeholder change, got: %s", output)
+	}
+	if files := gitOutput(t, monoDir, "ls-tree", "-r", "--name-only", "ph-repo1"); files != "README.md\nchange.txt" {
+		t.Errorf("Expected ph-repo1 to have only repo1's files, got %q", files)
+	}
+	if branches := gitOutput(t, monoDir, "for-each-ref", "--format=%(refname:short)", "refs/heads/ph-*"); branches != "ph-repo1" {
+		t.Errorf("Expected only a branch for repo1, got %q", branches)
+	}
+
+	for _, dir := range []string{"repo1", "repo1/inner", "../outside", "planned", "."} {
+		args := []string{"-no-fetch", "-empty", "planned", "-empty", dir, "repo1/master"}
+		if code, output := runToolExitCode(t, monoDir, "git-stitch", args...); code != 2 {
+			t.Errorf("Expected exit code 2 for -empty %s, got %d: %s", dir, code, output)
+		}
+	}
+}
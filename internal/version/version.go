@@ -0,0 +1,53 @@
+// Package version reports build metadata shared by git-stitch and git-rip,
+// so that both binaries describe themselves the same way.
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at link time, for example:
+//
+//	go build -ldflags "-X github.com/philz/git-stitch/internal/version.Version=v1.2.3"
+//
+// Anything left empty falls back to the build info embedded by the Go
+// toolchain.
+var (
+	Version string
+	Commit  string
+	Date    string
+)
+
+// String returns "<version> (commit <commit>, built <date>, <go version>)",
+// with "unknown" for anything neither the linker nor the build info
+// recorded.
+func String() string {
+	version, commit, date := Version, Commit, Date
+	goVersion := runtime.Version()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if version == "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
+		goVersion = info.GoVersion
+	}
+	if version == "" {
+		version = "dev"
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", version, commit, date, goVersion)
+}